@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strings"
+)
+
+// homeParents are directories whose children are user names.
+var homeParents = map[string]bool{"users": true, "home": true, "documents and settings": true}
+
+// anonymizer replaces user names, computer names and configured path segments
+// with tokens such as user1 or private2. The same input always maps to the same
+// token, so duplicate groups and per-folder grouping survive anonymization.
+// A nil anonymizer returns its input unchanged.
+type anonymizer struct {
+	private map[string]bool
+	users   map[string]bool
+	tokens  map[string]string
+	counts  map[string]int
+}
+
+func newAnonymizer(segments []string) *anonymizer {
+	a := &anonymizer{
+		private: map[string]bool{},
+		users:   map[string]bool{},
+		tokens:  map[string]string{},
+		counts:  map[string]int{},
+	}
+	for _, s := range segments {
+		a.private[strings.ToLower(s)] = true
+	}
+	if u, err := user.Current(); err == nil {
+		name := u.Username
+		if i := strings.LastIndexAny(name, `\/`); i >= 0 {
+			name = name[i+1:]
+		}
+		if name != "" {
+			a.users[strings.ToLower(name)] = true
+		}
+	}
+	return a
+}
+
+// token returns the stable token for value within kind. Values are compared
+// case-insensitively since Windows paths are.
+func (a *anonymizer) token(kind, value string) string {
+	key := kind + "\x00" + strings.ToLower(value)
+	if t, ok := a.tokens[key]; ok {
+		return t
+	}
+	a.counts[kind]++
+	t := fmt.Sprintf("%s%d", kind, a.counts[kind])
+	a.tokens[key] = t
+	return t
+}
+
+// path anonymizes each segment of a Windows or Unix path, keeping separators.
+func (a *anonymizer) path(p string) string {
+	if a == nil {
+		return p
+	}
+	var b strings.Builder
+	parent := ""
+	for p != "" {
+		i := strings.IndexAny(p, `\/`)
+		segment, sep := p, ""
+		if i >= 0 {
+			segment, sep = p[:i], p[i:i+1]
+		}
+		lower := strings.ToLower(segment)
+		switch {
+		case segment == "":
+		case homeParents[parent] || a.users[lower]:
+			segment = a.token("user", segment)
+		case a.private[lower]:
+			segment = a.token("private", segment)
+		}
+		b.WriteString(segment)
+		b.WriteString(sep)
+		parent = lower
+		if i < 0 {
+			break
+		}
+		p = p[i+1:]
+	}
+	return b.String()
+}
+
+// computer anonymizes a computer name. Manifest rows keep their marker.
+func (a *anonymizer) computer(name string) string {
+	if a == nil || name == "" || name == manifestComputer {
+		return name
+	}
+	return a.token("computer", name)
+}
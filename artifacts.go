@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// artifactSet holds the tool's own working files (database, journals, reports,
+// traces, config, plans, logs and quarantine folders) so scans never index
+// them. A directory in the set is skipped with everything under it.
+type artifactSet map[string]bool
+
+// sqliteSidecars are the files SQLite keeps next to an open database.
+var sqliteSidecars = []string{"", "-wal", "-shm", "-journal"}
+
+func normalizeArtifactPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	path = filepath.Clean(path)
+	if runtime.GOOS == "windows" {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+func (a artifactSet) add(paths ...string) {
+	for _, p := range paths {
+		if p != "" {
+			a[normalizeArtifactPath(p)] = true
+		}
+	}
+}
+
+// addDatabase adds the database file and its SQLite sidecar files.
+func (a artifactSet) addDatabase(dbPath string) {
+	for _, suffix := range sqliteSidecars {
+		a.add(dbPath + suffix)
+	}
+}
+
+// with returns a copy of the set that also contains paths.
+func (a artifactSet) with(paths ...string) artifactSet {
+	c := make(artifactSet, len(a)+len(paths))
+	for p := range a {
+		c[p] = true
+	}
+	c.add(paths...)
+	return c
+}
+
+func (a artifactSet) contains(path string) bool {
+	return len(a) > 0 && a[normalizeArtifactPath(path)]
+}
+
+// Plan files -dry-run wrote and logs apply-plan -log appended to, so scans in
+// later runs still skip them wherever they were put.
+const artifactsSchema = `
+CREATE TABLE IF NOT EXISTS artifacts (
+	path TEXT PRIMARY KEY
+);`
+
+// recordArtifact remembers a file dff wrote outside the database.
+func recordArtifact(db *sql.DB, path string) error {
+	if _, err := db.Exec("INSERT OR IGNORE INTO artifacts(path) VALUES(?)", normalizeArtifactPath(path)); err != nil {
+		return fmt.Errorf("failed to record %s: %v", path, err)
+	}
+	return nil
+}
+
+// addRecorded adds what earlier runs left behind: the files recordArtifact
+// remembered and the folders dedupe -quarantine moved copies into.
+func (a artifactSet) addRecorded(db *sql.DB) error {
+	rows, err := db.Query("SELECT path FROM artifacts")
+	if err != nil {
+		return fmt.Errorf("failed to query artifacts: %v", err)
+	}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+		a.add(path)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	rows, err = db.Query("SELECT DISTINCT path, quarantine_path FROM quarantine")
+	if err != nil {
+		return fmt.Errorf("failed to query quarantine: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path, dest string
+		if err := rows.Scan(&path, &dest); err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+		a.add(quarantineRoot(path, dest))
+	}
+	return rows.Err()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The audit tables are append-only: triggers reject every UPDATE and DELETE,
+// each scan gets its own session and its own copy of every row, and each
+// sealed session stores a hash chained to the previous seal so edits made
+// outside the tool (which can drop the triggers) are still detectable.
+const auditSchema = `
+CREATE TABLE IF NOT EXISTS audit_sessions (
+	id INTEGER PRIMARY KEY,
+	started_at TEXT NOT NULL,
+	computer TEXT,
+	drives TEXT
+);
+CREATE TABLE IF NOT EXISTS audit_files (
+	id INTEGER PRIMARY KEY,
+	session_id INTEGER NOT NULL REFERENCES audit_sessions(id),
+	path TEXT NOT NULL,
+	computer TEXT,
+	disk_label TEXT,
+	size INTEGER
+);
+CREATE TABLE IF NOT EXISTS audit_seals (
+	session_id INTEGER PRIMARY KEY REFERENCES audit_sessions(id),
+	finished_at TEXT NOT NULL,
+	file_count INTEGER NOT NULL,
+	rows_digest TEXT NOT NULL,
+	prev_hash TEXT NOT NULL,
+	hash TEXT NOT NULL
+);
+CREATE TRIGGER IF NOT EXISTS audit_sessions_no_update BEFORE UPDATE ON audit_sessions
+BEGIN SELECT RAISE(ABORT, 'audit_sessions is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS audit_sessions_no_delete BEFORE DELETE ON audit_sessions
+BEGIN SELECT RAISE(ABORT, 'audit_sessions is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS audit_files_no_update BEFORE UPDATE ON audit_files
+BEGIN SELECT RAISE(ABORT, 'audit_files is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS audit_files_no_delete BEFORE DELETE ON audit_files
+BEGIN SELECT RAISE(ABORT, 'audit_files is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS audit_seals_no_update BEFORE UPDATE ON audit_seals
+BEGIN SELECT RAISE(ABORT, 'audit_seals is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS audit_seals_no_delete BEFORE DELETE ON audit_seals
+BEGIN SELECT RAISE(ABORT, 'audit_seals is append-only'); END;
+`
+
+type auditSession struct {
+	db        *sql.DB
+	id        int64
+	startedAt string
+	computer  string
+	drives    string
+}
+
+func startAuditSession(db *sql.DB, computerName string, drives []string) (*auditSession, error) {
+	s := &auditSession{
+		db:        db,
+		startedAt: time.Now().UTC().Format(time.RFC3339),
+		computer:  computerName,
+		drives:    strings.Join(drives, ";"),
+	}
+	res, err := db.Exec("INSERT INTO audit_sessions(started_at, computer, drives) VALUES(?, ?, ?)", s.startedAt, s.computer, s.drives)
+	if err != nil {
+		return nil, err
+	}
+	if s.id, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// recorder appends walked files to this session's rows for one drive.
+func (s *auditSession) recorder(computerName, diskLabel string) (fileRecorder, func() error, error) {
+	stmt, err := s.db.Prepare("INSERT INTO audit_files(session_id, path, computer, disk_label, size) VALUES(?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, nil, err
+	}
+	record := func(e walkedEntry) error {
+		_, err := stmt.Exec(s.id, e.path, computerName, diskLabel, e.size)
+		return err
+	}
+	return record, stmt.Close, nil
+}
+
+// seal records the digest of the session's rows and the chained hash,
+// returning the new chain head.
+func (s *auditSession) seal(fileCount int64) (string, error) {
+	digest, err := auditRowsDigest(s.db, s.id)
+	if err != nil {
+		return "", err
+	}
+	var prevHash string
+	err = s.db.QueryRow("SELECT hash FROM audit_seals ORDER BY session_id DESC LIMIT 1").Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	finishedAt := time.Now().UTC().Format(time.RFC3339)
+	hash := auditChainHash(prevHash, s.id, s.startedAt, finishedAt, s.computer, s.drives, fileCount, digest)
+	_, err = s.db.Exec("INSERT INTO audit_seals(session_id, finished_at, file_count, rows_digest, prev_hash, hash) VALUES(?, ?, ?, ?, ?, ?)",
+		s.id, finishedAt, fileCount, digest, prevHash, hash)
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func auditRowsDigest(db *sql.DB, sessionID int64) (string, error) {
+	rows, err := db.Query("SELECT id, path, computer, disk_label, size FROM audit_files WHERE session_id = ? ORDER BY id", sessionID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	h := sha256.New()
+	for rows.Next() {
+		var id, size int64
+		var path, computer, diskLabel string
+		if err := rows.Scan(&id, &path, &computer, &diskLabel, &size); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%d\x00%s\x00%s\x00%s\x00%d\n", id, path, computer, diskLabel, size)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func auditChainHash(prevHash string, sessionID int64, startedAt, finishedAt, computer, drives string, fileCount int64, rowsDigest string) string {
+	fields := []string{prevHash, strconv.FormatInt(sessionID, 10), startedAt, finishedAt, computer, drives, strconv.FormatInt(fileCount, 10), rowsDigest}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyAuditChain recomputes every seal in order and reports the first
+// session whose rows or metadata no longer match its chained hash.
+func verifyAuditChain(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`SELECT s.id, s.started_at, s.computer, s.drives,
+		seal.finished_at, seal.file_count, seal.rows_digest, seal.prev_hash, seal.hash
+		FROM audit_sessions s LEFT JOIN audit_seals seal ON seal.session_id = s.id
+		ORDER BY s.id`)
+	if err != nil {
+		return err
+	}
+	type sealedSession struct {
+		id                                 int64
+		startedAt, computer, drives        string
+		finishedAt, digest, prevHash, hash sql.NullString
+		fileCount                          sql.NullInt64
+	}
+	var sessions []sealedSession
+	for rows.Next() {
+		var s sealedSession
+		if err := rows.Scan(&s.id, &s.startedAt, &s.computer, &s.drives, &s.finishedAt, &s.fileCount, &s.digest, &s.prevHash, &s.hash); err != nil {
+			rows.Close()
+			return err
+		}
+		sessions = append(sessions, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	head := ""
+	sealed := 0
+	for _, s := range sessions {
+		if !s.hash.Valid {
+			fmt.Fprintf(w, "Session %d (started %s) was never sealed; its rows are not covered by the chain.\n", s.id, s.startedAt)
+			continue
+		}
+		if s.prevHash.String != head {
+			return fmt.Errorf("session %d does not chain to the previous seal", s.id)
+		}
+		digest, err := auditRowsDigest(db, s.id)
+		if err != nil {
+			return err
+		}
+		if digest != s.digest.String {
+			return fmt.Errorf("rows of session %d were modified after sealing", s.id)
+		}
+		expected := auditChainHash(head, s.id, s.startedAt, s.finishedAt.String, s.computer, s.drives, s.fileCount.Int64, digest)
+		if expected != s.hash.String {
+			return fmt.Errorf("metadata of session %d was modified after sealing", s.id)
+		}
+		head = s.hash.String
+		sealed++
+	}
+	fmt.Fprintf(w, "Audit chain intact: %d sealed session(s), head %s\n", sealed, head)
+	return nil
+}
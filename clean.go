@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type indexedPath struct {
+	id   int64
+	path string
+}
+
+// nextIndexedPaths returns up to limit rows under root on the given computer
+// and disk with ids above afterID. A nonzero unseenBy keeps only the rows that
+// scan did not record.
+func nextIndexedPaths(db *sql.DB, computerName, diskLabel, root string, relative bool, unseenBy, afterID int64, limit int) ([]indexedPath, error) {
+	prefix := root
+	if relative {
+		prefix = ""
+	}
+	rows, err := db.Query(`SELECT id, path FROM files
+		WHERE computer = ? AND disk_label = ? AND substr(path, 1, ?) = ? AND id > ?
+		AND (?6 = 0 OR scan_id IS NOT ?6) AND removed_at IS NULL
+		ORDER BY id LIMIT ?`, computerName, diskLabel, len(prefix), prefix, afterID, unseenBy, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batch []indexedPath
+	for rows.Next() {
+		var p indexedPath
+		if err := rows.Scan(&p.id, &p.path); err != nil {
+			return nil, err
+		}
+		batch = append(batch, p)
+	}
+	return batch, rows.Err()
+}
+
+// pruneDrive marks the rows for one drive whose files no longer exist as
+// removed, keeping them with the time they were found missing, and returns
+// how many were marked. Files that can't be checked for any other reason are
+// kept. With a nonzero unseenBy only rows that scan missed are checked. With
+// a plan, the rows are written to it instead of being marked.
+func pruneDrive(ctx context.Context, db *sql.DB, progress *driveProgress, computerName, diskLabel, root string, relative bool, unseenBy int64, plan *planWriter) (int, error) {
+	remove, err := db.Prepare("UPDATE files SET removed_at = ? WHERE id = ?")
+	if err != nil {
+		return 0, err
+	}
+	defer remove.Close()
+
+	removed := 0
+	var lastID int64
+	for {
+		batch, err := nextIndexedPaths(db, computerName, diskLabel, root, relative, unseenBy, lastID, hashBatchSize)
+		if err != nil {
+			return removed, err
+		}
+		if len(batch) == 0 {
+			return removed, nil
+		}
+		for _, p := range batch {
+			if ctx.Err() != nil {
+				return removed, ctx.Err()
+			}
+			lastID = p.id
+			progress.files.Add(1)
+			path := p.path
+			if relative {
+				path = filepath.Join(root, p.path)
+			}
+			if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+				if err != nil {
+					stats.addError("stat", err)
+				}
+				continue
+			}
+			if plan != nil {
+				op := planOp{Op: planForget, Computer: computerName, DiskLabel: diskLabel, Path: p.path}
+				if relative {
+					op.Root = root
+				}
+				plan.write(op)
+				removed++
+				continue
+			}
+			if _, err := remove.Exec(time.Now().UTC().Format(time.RFC3339), p.id); err != nil {
+				stats.addError("insert", err)
+				progress.logf("[ERROR] Failed to remove %s: %v\n", path, err)
+				continue
+			}
+			removed++
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// config is the optional JSON configuration file. Every field may be omitted.
+type config struct {
+	// Theme names the report theme used when -theme is not given.
+	Theme string `json:"theme"`
+	// HashAlgo names the content hash used when -hash-algo is not given.
+	HashAlgo string `json:"hash_algo"`
+	// Themes adds or overrides report themes by name.
+	Themes map[string]reportTheme `json:"themes"`
+	// Anonymize lists extra path segments, such as client or project names,
+	// that -anonymize replaces with tokens.
+	Anonymize []string `json:"anonymize"`
+	// CompareTool is the command triage runs to compare two copies, e.g.
+	// ["WinMergeU.exe", "{1}", "{2}"]. The two paths are appended when the
+	// arguments contain no {1} or {2}.
+	CompareTool []string `json:"compare_tool"`
+	// Sidecars overrides which files count as sidecars of a primary and how
+	// they follow it. Defaults to XMP, THM and SRT moving together.
+	Sidecars *sidecarConfig `json:"sidecars"`
+	// PrivacyZones lists directories, such as a password manager's vault,
+	// whose files are indexed by size only and never opened or hashed.
+	PrivacyZones []string `json:"privacy_zones"`
+	// Protected lists folders, or -exclude style patterns, whose files no
+	// cleanup ever deletes, moves or links, e.g. C:\Windows.
+	Protected []string `json:"protected"`
+	// Locale is the BCP 47 tag, such as "sv" or "de-DE", whose collation
+	// orders paths in reports. Defaults to the user's locale.
+	Locale string `json:"locale"`
+	// Hashing assigns a hashing strategy, full, sample or skip, to file
+	// extensions, e.g. {".vmdk": "sample"}. Unlisted extensions are hashed
+	// in full.
+	Hashing map[string]string `json:"hashing"`
+}
+
+// loadConfig reads the configuration file at path. A missing file yields an
+// empty configuration so the tool works without one.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+	}
+	return cfg, nil
+}
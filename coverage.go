@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/text/message"
+)
+
+// Coverage states for a master file.
+const (
+	coverageBackedUp   = "backed up"
+	coverageUnverified = "unverified"
+	coverageMissing    = "no copy"
+)
+
+// coverageQuery classifies every non-empty file under a masters tree. A copy
+// counts only if it is on another volume, meaning another computer or disk
+// label. Files that share a size with such a copy but haven't been hashed far
+// enough to tell are unverified rather than missing, and so are files whose
+// only match is a sampled hash, since not every byte was compared.
+const coverageQuery = `SELECT m.path, m.size, CASE
+	WHEN m.hash IS NOT NULL AND m.hash NOT LIKE '` + samplePrefix + `%' AND EXISTS (SELECT 1 FROM files c
+		WHERE c.removed_at IS NULL AND c.size = m.size AND c.hash = m.hash AND c.hash_algo = m.hash_algo
+		AND NOT (c.computer = m.computer AND c.disk_label = m.disk_label)) THEN 'backed up'
+	WHEN EXISTS (SELECT 1 FROM files c
+		WHERE c.removed_at IS NULL AND c.size = m.size AND NOT (c.computer = m.computer AND c.disk_label = m.disk_label)
+		AND (m.hash IS NULL OR c.hash IS NULL OR c.hash_algo IS NOT m.hash_algo
+			OR m.hash LIKE '` + samplePrefix + `%' OR c.hash LIKE '` + samplePrefix + `%')
+		AND (m.quick_hash IS NULL OR c.quick_hash IS NULL OR c.hash_algo IS NOT m.hash_algo
+			OR c.quick_hash = m.quick_hash
+			OR (m.quick_hash LIKE '` + samplePrefix + `%') != (c.quick_hash LIKE '` + samplePrefix + `%'))) THEN 'unverified'
+	ELSE 'no copy' END
+	FROM files m
+	WHERE m.computer = ? AND substr(m.path, 1, ?) = ? AND m.size > 0 AND m.removed_at IS NULL`
+
+// coverageEntry is a master file listed in the coverage report.
+type coverageEntry struct {
+	path, state string
+	size        int64
+}
+
+// printCoverage reports the files under each masters tree that have no copy
+// on another volume, turning the duplicate index into a backup check. Each
+// tree's files are listed in paths order.
+func printCoverage(db *sql.DB, w io.Writer, masters []string, anon *anonymizer, paths *pathOrder) error {
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	computerName := getComputerName()
+	counts := map[string]int{}
+	var missingBytes int64
+	for _, root := range masters {
+		prefix := root
+		if !strings.HasSuffix(prefix, string(os.PathSeparator)) {
+			prefix += string(os.PathSeparator)
+		}
+		rows, err := db.Query(coverageQuery, computerName, len(prefix), prefix)
+		if err != nil {
+			return fmt.Errorf("failed to query masters: %v", err)
+		}
+		var listed []coverageEntry
+		for rows.Next() {
+			var path, state string
+			var size int64
+			if err := rows.Scan(&path, &size, &state); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan row: %v", err)
+			}
+			counts[state]++
+			if state == coverageBackedUp {
+				continue
+			}
+			if state == coverageMissing {
+				missingBytes += size
+			}
+			listed = append(listed, coverageEntry{path, state, size})
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read masters: %v", err)
+		}
+		slices.SortFunc(listed, func(a, b coverageEntry) int { return paths.compare(a.path, b.path) })
+		for _, e := range listed {
+			p.Fprintf(w, "  [%s] %s (%d bytes)\n", e.state, anon.path(e.path), e.size)
+		}
+	}
+	total := counts[coverageBackedUp] + counts[coverageUnverified] + counts[coverageMissing]
+	if total == 0 {
+		fmt.Fprintln(w, "No recorded files under the masters trees; scan them first.")
+		return nil
+	}
+	p.Fprintf(w, "%d master files: %d backed up, %d with no copy on another volume (%d bytes), %d unverified.\n",
+		total, counts[coverageBackedUp], counts[coverageMissing], missingBytes, counts[coverageUnverified])
+	if counts[coverageUnverified] > 0 {
+		fmt.Fprintln(w, "Run \"dff hash\" on the drives involved to settle the unverified files.")
+	}
+	return nil
+}
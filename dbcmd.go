@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/text/message"
+)
+
+func dbUsage(fs *flag.FlagSet) {
+	fmt.Fprintln(fs.Output(), `Usage: dff db [-db files.db] <command> [arguments]
+
+Commands:
+  list-computers               List computers with their file counts and sizes.
+  list-scans                   List recent scans with when they ran, what they covered and what they found.
+  rename-computer OLD NEW      Rename a computer's rows (use -merge if NEW already exists).
+  forget-computer NAME         Delete every row belonging to a computer.
+  remap OLD NEW                Move recorded paths under OLD to NEW (e.g. E:\Photos F:\Photos),
+                               keeping their hashes (use -merge if NEW was already scanned).
+  query "SELECT ..."           Run SQL against the index and print the rows as a table
+                               (read-only unless -write; -csv FILE to export).
+  enable-checksums             Keep a checksum of every file row so changes made outside dff show up.
+  verify-integrity             Check the database for corruption and rows that don't match their checksums
+                               (-write deletes those rows so the next scan records them again).
+
+Flags:`)
+	fs.PrintDefaults()
+}
+
+// runDBCommand implements the "db" maintenance subcommands and returns the
+// process exit code.
+func runDBCommand(args []string) int {
+	fs := flag.NewFlagSet("db", flag.ExitOnError)
+	dbPath := fs.String("db", "files.db", "Path of the SQLite database.")
+	safeDB := fs.Bool("safe-db", false, "Open the database with SQLite's rollback journal and full syncs instead of WAL.")
+	merge := fs.Bool("merge", false, "rename-computer, remap: merge into NEW when it already exists, replacing its conflicting rows.")
+	computer := fs.String("computer", getComputerName(), "remap: computer whose paths are rewritten.")
+	label := fs.String("label", "", "remap: also set the disk label of the remapped rows.")
+	write := fs.Bool("write", false, "query: allow statements that modify the database. verify-integrity: delete rows that don't match their checksums.")
+	csvPath := fs.String("csv", "", "query: write the rows as CSV to this file (- for stdout) instead of a table.")
+	fs.Usage = func() { dbUsage(fs) }
+	positional := parseInterspersed(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	db, err := setupDatabase(*dbPath, *safeDB)
+	if err != nil {
+		fmt.Printf("Failed to open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	cmd, cmdArgs := positional[0], positional[1:]
+	switch {
+	case cmd == "list-computers" && len(cmdArgs) == 0:
+		err = listComputers(db)
+	case cmd == "list-scans" && len(cmdArgs) == 0:
+		err = listScans(db)
+	case cmd == "rename-computer" && len(cmdArgs) == 2:
+		err = renameComputer(db, cmdArgs[0], cmdArgs[1], *merge)
+	case cmd == "forget-computer" && len(cmdArgs) == 1:
+		err = forgetComputer(db, cmdArgs[0])
+	case cmd == "remap" && len(cmdArgs) == 2:
+		err = remapPaths(db, *computer, cmdArgs[0], cmdArgs[1], *label, *merge)
+	case cmd == "query" && len(cmdArgs) == 1:
+		err = runQuery(db, cmdArgs[0], *write, *csvPath)
+	case cmd == "enable-checksums" && len(cmdArgs) == 0:
+		err = enableRowSums(db)
+	case cmd == "verify-integrity" && len(cmdArgs) == 0:
+		var problems int
+		if problems, err = verifyIntegrity(db, os.Stdout, *write); err == nil && problems > 0 {
+			return 1
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses args with fs, allowing flags after the positional
+// arguments as well as before them, as in dff db query "SELECT ..." -csv out.csv,
+// and returns the positional arguments in order. Everything after -- is
+// positional.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if i := len(args) - len(rest); i > 0 && args[i-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func listComputers(db *sql.DB) error {
+	rows, err := db.Query("SELECT COALESCE(computer, ''), COUNT(*), COALESCE(SUM(size), 0) FROM files WHERE removed_at IS NULL GROUP BY computer ORDER BY computer")
+	if err != nil {
+		return fmt.Errorf("failed to query computers: %v", err)
+	}
+	defer rows.Close()
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	p.Fprintf(os.Stdout, "%-30s %12s %18s\n", "COMPUTER", "FILES", "BYTES")
+	for rows.Next() {
+		var computer string
+		var count, size int64
+		if err := rows.Scan(&computer, &count, &size); err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+		p.Fprintf(os.Stdout, "%-30s %12d %18d\n", computer, count, size)
+	}
+	return rows.Err()
+}
+
+// listScans prints the most recent scans, newest first. A scan without an end
+// time was interrupted or failed before its walk completed.
+func listScans(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, started_at, COALESCE(finished_at, ''), COALESCE(computer, ''), root,
+		COALESCE(file_count, 0), COALESCE(error_count, 0), COALESCE(total_bytes, 0)
+		FROM scans ORDER BY id DESC LIMIT 50`)
+	if err != nil {
+		return fmt.Errorf("failed to query scans: %v", err)
+	}
+	defer rows.Close()
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	p.Fprintf(os.Stdout, "%6s %-20s %-20s %-20s %12s %8s %18s  %s\n", "ID", "STARTED", "FINISHED", "COMPUTER", "FILES", "ERRORS", "BYTES", "ROOT")
+	for rows.Next() {
+		var id, files, errs, size int64
+		var started, finished, computer, root string
+		if err := rows.Scan(&id, &started, &finished, &computer, &root, &files, &errs, &size); err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+		if finished == "" {
+			finished = "incomplete"
+		}
+		p.Fprintf(os.Stdout, "%6d %-20s %-20s %-20s %12d %8d %18d  %s\n", id, started, finished, computer, files, errs, size, root)
+	}
+	return rows.Err()
+}
+
+func computerRowCount(db *sql.DB, computer string) (int64, error) {
+	var count int64
+	err := db.QueryRow("SELECT COUNT(*) FROM files WHERE computer = ?", computer).Scan(&count)
+	return count, err
+}
+
+func renameComputer(db *sql.DB, oldName, newName string, merge bool) error {
+	count, err := computerRowCount(db, oldName)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no rows for computer %q", oldName)
+	}
+	existing, err := computerRowCount(db, newName)
+	if err != nil {
+		return err
+	}
+	if existing > 0 && !merge {
+		return fmt.Errorf("computer %q already has %d rows; pass -merge to combine them", newName, existing)
+	}
+	// OR REPLACE lets the renamed rows win where both computers indexed the same path.
+	res, err := db.Exec("UPDATE OR REPLACE files SET computer = ? WHERE computer = ?", newName, oldName)
+	if err != nil {
+		return fmt.Errorf("failed to rename computer: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	message.NewPrinter(message.MatchLanguage("en")).Printf("Renamed %d rows from %q to %q\n", n, oldName, newName)
+	return nil
+}
+
+func forgetComputer(db *sql.DB, name string) error {
+	res, err := db.Exec("DELETE FROM files WHERE computer = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete rows: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("no rows for computer %q", name)
+	}
+	message.NewPrinter(message.MatchLanguage("en")).Printf("Deleted %d rows belonging to %q\n", n, name)
+	return nil
+}
+
+// trimPathPrefix drops trailing separators, so E:\ and E: name the same tree,
+// and returns the separator the path uses.
+func trimPathPrefix(p string) (string, string) {
+	sep := "/"
+	if strings.Contains(p, `\`) || len(p) == 2 && p[1] == ':' {
+		sep = `\`
+	}
+	return strings.TrimRight(p, `/\`), sep
+}
+
+// remapPaths rewrites the paths of one computer's rows from the oldRoot tree
+// to newRoot, after a drive changes letter or a folder is moved, so hashes
+// survive without a re-scan. Rows whose disk label is the old root itself
+// (Linux mount points) are relabelled too, and label, when given, relabels
+// every remapped row.
+func remapPaths(db *sql.DB, computer, oldRoot, newRoot, label string, merge bool) error {
+	oldRoot, oldSep := trimPathPrefix(oldRoot)
+	newRoot, _ = trimPathPrefix(newRoot)
+	const match = "computer = ? AND (path = ? OR substr(path, 1, ?) = ?)"
+	under := func(root string) []any {
+		return []any{computer, root, len(root) + len(oldSep), root + oldSep}
+	}
+
+	var count, existing int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE "+match, under(oldRoot)...).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no rows for computer %q under %s", computer, oldRoot+oldSep)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE "+match, under(newRoot)...).Scan(&existing); err != nil {
+		return err
+	}
+	if existing > 0 && !merge {
+		return fmt.Errorf("computer %q already has %d rows under %s; pass -merge to combine them", computer, existing, newRoot)
+	}
+
+	newLabel := any(nil)
+	if label != "" {
+		newLabel = label
+	}
+	// OR REPLACE lets the remapped rows, which carry the hashes, win over rows
+	// a scan under the new path already recorded.
+	res, err := db.Exec(`UPDATE OR REPLACE files SET path = ? || substr(path, ?),
+		disk_label = COALESCE(?, CASE WHEN disk_label = ? THEN ? ELSE disk_label END)
+		WHERE `+match, append([]any{newRoot, len(oldRoot) + 1, newLabel, oldRoot, newRoot}, under(oldRoot)...)...)
+	if err != nil {
+		return fmt.Errorf("failed to remap paths: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	message.NewPrinter(message.MatchLanguage("en")).Printf("Remapped %d rows from %s to %s\n", n, oldRoot, newRoot)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	for _, tc := range []struct {
+		args       []string
+		positional []string
+		csv        string
+	}{
+		{[]string{"-csv", "out.csv", "query", "SELECT 1"}, []string{"query", "SELECT 1"}, "out.csv"},
+		{[]string{"query", "SELECT 1", "-csv", "out.csv"}, []string{"query", "SELECT 1"}, "out.csv"},
+		{[]string{"query", "-csv", "out.csv", "SELECT 1"}, []string{"query", "SELECT 1"}, "out.csv"},
+		{[]string{"query", "--", "-csv"}, []string{"query", "-csv"}, ""},
+		{nil, nil, ""},
+	} {
+		fs := flag.NewFlagSet("db", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		csvPath := fs.String("csv", "", "")
+		positional := parseInterspersed(fs, tc.args)
+		if !slices.Equal(positional, tc.positional) || *csvPath != tc.csv {
+			t.Errorf("%q: got %q and -csv %q, want %q and %q", tc.args, positional, *csvPath, tc.positional, tc.csv)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// queryValue renders a column value for table or CSV output.
+func queryValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// runQuery runs an ad-hoc SQL statement and prints its rows as a table, or
+// writes them to csvPath ("-" for stdout). Unless write is set the connection
+// is switched to query_only first, so statements that modify the database
+// fail instead of running.
+func runQuery(db *sql.DB, query string, write bool, csvPath string) error {
+	if !write {
+		if _, err := db.Exec("PRAGMA query_only = ON"); err != nil {
+			return fmt.Errorf("failed to make the database read-only: %v", err)
+		}
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("failed to read columns: %v", err)
+	}
+	if len(columns) == 0 {
+		fmt.Println("OK")
+		return rows.Err()
+	}
+
+	var emit func([]string) error
+	var flush func() error
+	if csvPath != "" {
+		var out io.Writer = os.Stdout
+		if csvPath != "-" {
+			file, err := os.Create(csvPath)
+			if err != nil {
+				return fmt.Errorf("failed to create CSV file: %v", err)
+			}
+			defer file.Close()
+			out = file
+		}
+		w := csv.NewWriter(out)
+		emit = w.Write
+		flush = func() error {
+			w.Flush()
+			return w.Error()
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		emit = func(record []string) error {
+			_, err := fmt.Fprintln(w, strings.Join(record, "\t"))
+			return err
+		}
+		flush = w.Flush
+	}
+
+	if err := emit(columns); err != nil {
+		return err
+	}
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	record := make([]string, len(columns))
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+		for i, v := range values {
+			record[i] = queryValue(v)
+		}
+		if err := emit(record); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if csvPath != "-" {
+		fmt.Printf("(%d rows)\n", count)
+	}
+	return nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/text/message"
+)
+
+// Keep rules for dedupe: which copy of each duplicate set survives.
+const (
+	keepNewest       = "newest"
+	keepOldest       = "oldest"
+	keepCreatedFirst = "created-first"
+	keepShortestPath = "shortest-path"
+	keepFirstIn      = "first-in"
+)
+
+var keepRules = []string{keepNewest, keepOldest, keepCreatedFirst, keepShortestPath, keepFirstIn}
+
+// Dedupe actions: what happens to the copies that aren't kept.
+const (
+	dedupeDelete   = "delete"
+	dedupeHardlink = "hardlink"
+)
+
+func checkDedupeAction(action string) error {
+	if action != dedupeDelete && action != dedupeHardlink {
+		return fmt.Errorf("unknown dedupe action %q (want %s or %s)", action, dedupeDelete, dedupeHardlink)
+	}
+	return nil
+}
+
+func checkKeepRule(rule, folder string) error {
+	switch rule {
+	case keepNewest, keepOldest, keepCreatedFirst, keepShortestPath:
+		return nil
+	case keepFirstIn:
+		if folder == "" {
+			return errors.New("-keep first-in needs the folder to keep from, e.g. dff dedupe -keep first-in D:\\Photos")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown keep rule %q (want %s)", rule, strings.Join(keepRules, ", "))
+}
+
+// dedupeCopy is one local copy in a dedupe plan, with the size and
+// modification time it was recorded with so a changed file is never deleted,
+// and its creation time for the created-first rule.
+type dedupeCopy struct {
+	diskLabel    string
+	path         string
+	size, mtime  int64
+	created      int64
+	sidecars     []sidecar
+	sidecarsWarn bool
+}
+
+// dedupeSet is a duplicate set with the copy to keep chosen and the rest
+// planned for deletion, except those under protected paths. rule is what
+// chose the kept copy, for the actions log. root is the volume root the
+// copies' paths are relative to, for rows recorded with -portable, and empty
+// when they are absolute.
+type dedupeSet struct {
+	key       string
+	size      int64
+	keep      dedupeCopy
+	remove    []dedupeCopy
+	protected []dedupeCopy
+	rule      string
+	root      string
+}
+
+// onDisk returns where the file recorded as path is on this computer.
+func (s dedupeSet) onDisk(path string) string {
+	if s.root == "" {
+		return path
+	}
+	return filepath.Join(s.root, path)
+}
+
+// pickKeep returns the index of the copy rule keeps, or false when the rule
+// can't decide: a copy's modification or creation time is unknown, or no
+// copy is under folder. created-first keeps the copy created first, which is
+// most likely the original. Ties go to the first copy in path order.
+func pickKeep(rule, folder string, copies []dedupeCopy) (int, bool) {
+	best := -1
+	for i, c := range copies {
+		switch rule {
+		case keepNewest, keepOldest:
+			if c.mtime == 0 {
+				return 0, false
+			}
+			if best < 0 || rule == keepNewest && c.mtime > copies[best].mtime || rule == keepOldest && c.mtime < copies[best].mtime {
+				best = i
+			}
+		case keepCreatedFirst:
+			if c.created == 0 {
+				return 0, false
+			}
+			if best < 0 || c.created < copies[best].created {
+				best = i
+			}
+		case keepShortestPath:
+			if best < 0 || len(c.path) < len(copies[best].path) {
+				best = i
+			}
+		case keepFirstIn:
+			if best < 0 && subtreeContains(folder, c.path) {
+				best = i
+			}
+		}
+	}
+	return best, best >= 0
+}
+
+// planDedupe groups this computer's copies by content hash and picks the one
+// to keep in each set. Only copies on this computer are considered, since
+// only they can be deleted and checked from here. Sets marked intentional in
+// triage are left alone, and a copy picked in triage wins over the rule. It
+// returns the plan and the sets the rule couldn't decide, planned as if their
+// first copy in path order were kept and with no rule, for review to decide.
+//
+// A hard link can't cross volumes, so for the hardlink action each volume's
+// copies form a set of their own, copies already linked to the kept one are
+// left out, and sidecars stay where they are since no path goes away.
+//
+// Copies and sidecars that protect covers are never planned for removal, and
+// are listed as protected instead.
+func planDedupe(db *sql.DB, computerName, algo, rule, folder, action string, sidecars sidecarConfig, protect protectedPaths) ([]dedupeSet, []dedupeSet, error) {
+	perVolume := action == dedupeHardlink
+	rows, err := db.Query(`SELECT COALESCE(f.disk_label, ''), f.path, f.size, COALESCE(f.mtime, 0), COALESCE(f.created, 0), f.hash, COALESCE(d.action, ''),
+		COALESCE(d.keep_computer = f.computer AND d.keep_path = f.path, 0)
+		FROM files f LEFT JOIN triage_decisions d ON d.hash_algo = f.hash_algo AND d.hash = f.hash AND d.size = f.size
+		WHERE f.computer = ?1 AND f.hash_algo = ?2 AND f.hash IS NOT NULL AND f.size > 0 AND f.removed_at IS NULL
+		AND f.hash NOT LIKE '`+samplePrefix+`%'
+		AND (f.hash, f.size) IN (SELECT hash, size FROM files
+			WHERE computer = ?1 AND hash_algo = ?2 AND hash IS NOT NULL AND size > 0 AND removed_at IS NULL
+			GROUP BY hash, size HAVING COUNT(*) > 1)
+		ORDER BY f.size DESC, f.hash, f.disk_label, f.path`, computerName, algo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query duplicate sets: %v", err)
+	}
+	type pending struct {
+		key     string
+		size    int64
+		volume  string
+		action  string
+		decided int
+		copies  []dedupeCopy
+	}
+	var sets []*pending
+	// The sets of the current hash start at first; there is one per volume
+	// for the hardlink action.
+	first := 0
+	for rows.Next() {
+		var c dedupeCopy
+		var key, action string
+		var chosen bool
+		if err := rows.Scan(&c.diskLabel, &c.path, &c.size, &c.mtime, &c.created, &key, &action, &chosen); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		volume := ""
+		if perVolume {
+			// Disk labels needn't be unique, so the volume is asked for. A
+			// copy that can't be found can't be linked either.
+			if volume, err = volumeOf(c.path); err != nil {
+				continue
+			}
+		}
+		if n := len(sets); n == 0 || sets[n-1].key != key || sets[n-1].size != c.size {
+			first = n
+		}
+		var s *pending
+		for _, p := range sets[first:] {
+			if p.volume == volume {
+				s = p
+			}
+		}
+		if s == nil {
+			s = &pending{key: key, size: c.size, volume: volume, action: action, decided: -1}
+			sets = append(sets, s)
+		}
+		if chosen {
+			s.decided = len(s.copies)
+		}
+		s.copies = append(s.copies, c)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	var plan, undecided []dedupeSet
+	for _, s := range sets {
+		if s.action == triageIgnore || len(s.copies) < 2 {
+			continue
+		}
+		keep, ok := s.decided, s.decided >= 0
+		chosenBy := "triage"
+		if !ok {
+			if keep, ok = pickKeep(rule, folder, s.copies); !ok {
+				keep, chosenBy = 0, ""
+			} else if chosenBy = rule; rule == keepFirstIn {
+				chosenBy += " " + folder
+			}
+		}
+		d := dedupeSet{key: s.key, size: s.size, keep: s.copies[keep], rule: chosenBy}
+		for i, c := range s.copies {
+			if i == keep {
+				continue
+			}
+			if perVolume && sameFile(d.keep.path, c.path) {
+				continue
+			}
+			if protect.protects(c.path) {
+				d.protected = append(d.protected, c)
+				continue
+			}
+			if perVolume {
+				d.remove = append(d.remove, c)
+				continue
+			}
+			if err := planRemoval(db, computerName, sidecars, protect, &d, c); err != nil {
+				return nil, nil, err
+			}
+		}
+		switch {
+		case !ok:
+			if len(d.remove) > 0 {
+				undecided = append(undecided, d)
+			}
+		case len(d.remove) > 0 || len(d.protected) > 0:
+			plan = append(plan, d)
+		}
+	}
+	return plan, undecided, nil
+}
+
+// planRemoval adds c to the copies d removes, along with its sidecars. Any
+// sidecar under a protected path is listed as protected instead.
+func planRemoval(db *sql.DB, computerName string, sidecars sidecarConfig, protect protectedPaths, d *dedupeSet, c dedupeCopy) error {
+	all, err := sidecars.findSidecars(db, computerName, c.diskLabel, c.path)
+	if err != nil {
+		return err
+	}
+	var found []sidecar
+	for _, sc := range all {
+		if protect.protects(sc.path) {
+			d.protected = append(d.protected, dedupeCopy{diskLabel: c.diskLabel, path: sc.path, size: sc.size})
+		} else {
+			found = append(found, sc)
+		}
+	}
+	if len(found) > 0 && sidecars.Action == sidecarsWarn {
+		c.sidecarsWarn = true
+	}
+	c.sidecars = found
+	d.remove = append(d.remove, c)
+	return nil
+}
+
+// sameFile reports whether a and b are already the same file, such as two
+// hard links to it.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
+
+// printDedupePlan lists what dedupe would keep and delete or link and returns
+// the number of files and bytes it would reclaim.
+func printDedupePlan(w io.Writer, plan []dedupeSet, undecided int, rule, action string) (int, int64) {
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	verb := "delete"
+	if action == dedupeHardlink {
+		verb = "link  "
+	}
+	files, bytes, protected := 0, int64(0), 0
+	for i, s := range plan {
+		p.Fprintf(w, "\nSet %d: %d copies of %d bytes\n", i+1, len(s.remove)+len(s.protected)+1, s.size)
+		fmt.Fprintf(w, "  keep    %s\n", s.keep.path)
+		for _, c := range s.remove {
+			fmt.Fprintf(w, "  %s  %s\n", verb, c.path)
+			files++
+			bytes += c.size
+			for _, sc := range c.sidecars {
+				if c.sidecarsWarn {
+					fmt.Fprintf(w, "      ! sidecar stays behind: %s\n", sc.path)
+					continue
+				}
+				fmt.Fprintf(w, "  delete  %s (sidecar)\n", sc.path)
+				files++
+				bytes += sc.size
+			}
+		}
+		for _, c := range s.protected {
+			fmt.Fprintf(w, "  kept    %s (protected)\n", c.path)
+			protected++
+		}
+	}
+	if action == dedupeHardlink {
+		p.Fprintf(w, "\nKeeping the %s copy: %d files to replace with hard links in %d sets, %d bytes reclaimed.\n", rule, files, len(plan), bytes)
+	} else {
+		p.Fprintf(w, "\nKeeping the %s copy: %d files to delete in %d sets, %d bytes reclaimed.\n", rule, files, len(plan), bytes)
+	}
+	if protected > 0 {
+		p.Fprintf(w, "%d files were kept because they are under protected paths.\n", protected)
+	}
+	if undecided > 0 {
+		p.Fprintf(w, "%d sets were left alone because the rule couldn't pick a copy; decide them in triage or review.\n", undecided)
+	}
+	return files, bytes
+}
+
+// confirmDedupe asks on in whether to go ahead. It refuses when stdin is not
+// a terminal, so a script has to pass -force. quarantine is the folder copies
+// are moved to instead of being deleted, if any.
+func confirmDedupe(in *os.File, w io.Writer, files int, action string, permanent bool, quarantine string) bool {
+	info, err := in.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fmt.Fprintln(w, "Nothing was deleted. Pass -force to delete without asking.")
+		return false
+	}
+	question := "Send %d files to the Recycle Bin? Type yes to continue: "
+	if action == dedupeHardlink {
+		question = "Replace %d files with hard links? Type yes to continue: "
+	} else if quarantine != "" {
+		question = "Move %d files to " + strings.ReplaceAll(quarantine, "%", "%%") + "? Type yes to continue: "
+	} else if permanent {
+		question = "Permanently delete %d files? Type yes to continue: "
+	}
+	message.NewPrinter(message.MatchLanguage("en")).Fprintf(w, question, files)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	if strings.TrimSpace(strings.ToLower(answer)) != "yes" {
+		fmt.Fprintln(w, "Nothing was deleted.")
+		return false
+	}
+	return true
+}
+
+// unchangedOnDisk returns an error unless the file at path still has the size
+// and modification time it was recorded with.
+func unchangedOnDisk(path string, size, mtime int64) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("no longer a regular file")
+	}
+	if info.Size() != size || mtime != 0 && info.ModTime().UnixNano() != mtime {
+		return errors.New("changed since it was hashed; rescan first")
+	}
+	return nil
+}
+
+// runDedupe removes the planned copies with removeFile, which is given each
+// copy's disk label, the path its row is recorded under and its path on disk,
+// and returns where the file went, if anywhere. Each removal is logged as
+// action, one of the plan operations delete, recycle or quarantine, the row
+// is deleted, and the copy is recorded as resolved. A set is skipped when its
+// kept copy has gone or changed, and a copy is kept when it changed since it
+// was hashed or, with verify, when it differs from the kept copy byte by
+// byte. A sidecar is kept when it changed since it was scanned. It returns
+// the number of files removed and the number that failed.
+func runDedupe(db *sql.DB, w io.Writer, computerName, algo, action string, plan []dedupeSet, verify bool, removeFile func(diskLabel, stored, path string) (string, error)) (int, int) {
+	deleted, failed := 0, 0
+	remove := func(s dedupeSet, a cleanupAction) bool {
+		target, err := removeFile(a.diskLabel, a.path, s.onDisk(a.path))
+		if err != nil {
+			fmt.Fprintf(w, "[ERROR] Failed to remove %s: %v\n", s.onDisk(a.path), err)
+			failed++
+			return false
+		}
+		deleted++
+		a.computer, a.action, a.target = computerName, action, target
+		if err := recordAction(db, a); err != nil {
+			fmt.Fprintf(w, "[ERROR] %v\n", err)
+		}
+		if _, err := db.Exec("DELETE FROM files WHERE computer = ? AND disk_label = ? AND path = ?", computerName, a.diskLabel, a.path); err != nil {
+			fmt.Fprintf(w, "[ERROR] Removed %s but failed to delete its row: %v\n", s.onDisk(a.path), err)
+		}
+		return true
+	}
+	for _, s := range plan {
+		if len(s.remove) == 0 {
+			continue
+		}
+		keep := s.keep
+		keep.path = s.onDisk(keep.path)
+		if err := unchangedOnDisk(keep.path, keep.size, keep.mtime); err != nil {
+			fmt.Fprintf(w, "Skipping the copies of %s: %v\n", keep.path, err)
+			continue
+		}
+		for _, c := range s.remove {
+			disk := c
+			disk.path = s.onDisk(c.path)
+			if err := unchangedOnDisk(disk.path, c.size, c.mtime); err != nil {
+				fmt.Fprintf(w, "Keeping %s: %v\n", disk.path, err)
+				continue
+			}
+			if verify {
+				if err := verifyCopy(keep, disk); err != nil {
+					fmt.Fprintf(w, "Keeping %s: %v\n", disk.path, err)
+					continue
+				}
+			}
+			if !remove(s, cleanupAction{diskLabel: c.diskLabel, path: c.path, hashAlgo: algo, hash: s.key, bytes: c.size, rule: s.rule}) {
+				continue
+			}
+			if err := recordResolved(db, computerName, algo, s, c, action); err != nil {
+				fmt.Fprintf(w, "[ERROR] %v\n", err)
+			}
+			if c.sidecarsWarn {
+				continue
+			}
+			for _, sc := range c.sidecars {
+				// A sidecar may have been deleted already as a duplicate itself.
+				if err := unchangedOnDisk(s.onDisk(sc.path), sc.size, sc.mtime); errors.Is(err, os.ErrNotExist) {
+					continue
+				} else if err != nil {
+					fmt.Fprintf(w, "Keeping %s: %v\n", s.onDisk(sc.path), err)
+					continue
+				}
+				remove(s, cleanupAction{diskLabel: c.diskLabel, path: sc.path, bytes: sc.size, rule: "sidecar of " + c.path})
+			}
+		}
+	}
+	return deleted, failed
+}
+
+// runHardlink replaces each planned copy with a hard link to the kept copy of
+// its set. Both files are hashed again first, so a copy whose content has
+// changed since the scan is never replaced, and neither is one whose owner
+// or permissions differ from the kept copy's, since the link would take on
+// the kept copy's. The link is made under a temporary name and renamed over
+// the copy, so the copy's path never goes missing. It returns the number of
+// files linked, the number that failed, and the bytes reclaimed. With verify,
+// each copy is also compared byte by byte with the kept one right before it
+// is replaced.
+func runHardlink(db *sql.DB, w io.Writer, computerName, algo string, plan []dedupeSet, verify bool) (int, int, int64) {
+	linked, failed := 0, 0
+	var reclaimed int64
+	var bytesRead atomic.Int64
+	for _, s := range plan {
+		if len(s.remove) == 0 {
+			continue
+		}
+		keep := s.keep
+		keep.path = s.onDisk(keep.path)
+		if err := unchangedOnDisk(keep.path, keep.size, keep.mtime); err != nil {
+			fmt.Fprintf(w, "Skipping the copies of %s: %v\n", keep.path, err)
+			continue
+		}
+		sum, _, err := hashFile(keep.path, algo, 0, &bytesRead)
+		if err != nil || sum != s.key {
+			fmt.Fprintf(w, "Skipping the copies of %s: its content no longer matches the index\n", keep.path)
+			continue
+		}
+		keepInfo, err := os.Stat(keep.path)
+		if err != nil {
+			fmt.Fprintf(w, "Skipping the copies of %s: %v\n", keep.path, err)
+			continue
+		}
+		for _, c := range s.remove {
+			disk := c
+			disk.path = s.onDisk(c.path)
+			if err := unchangedOnDisk(disk.path, c.size, c.mtime); err != nil {
+				fmt.Fprintf(w, "Keeping %s: %v\n", disk.path, err)
+				continue
+			}
+			if sum, _, err := hashFile(disk.path, algo, 0, &bytesRead); err != nil || sum != s.key {
+				fmt.Fprintf(w, "Keeping %s: its content no longer matches the index\n", disk.path)
+				continue
+			}
+			if err := sameAccess(keep.path, disk.path); err != nil {
+				fmt.Fprintf(w, "Keeping %s: %v\n", disk.path, err)
+				continue
+			}
+			if verify {
+				if err := verifyCopy(keep, disk); err != nil {
+					fmt.Fprintf(w, "Keeping %s: %v\n", disk.path, err)
+					continue
+				}
+			}
+			tmp := disk.path + ".dff-link"
+			if err := os.Link(keep.path, tmp); err != nil {
+				fmt.Fprintf(w, "[ERROR] Failed to link %s: %v\n", disk.path, err)
+				failed++
+				continue
+			}
+			if err := os.Rename(tmp, disk.path); err != nil {
+				os.Remove(tmp)
+				fmt.Fprintf(w, "[ERROR] Failed to replace %s with a link: %v\n", disk.path, err)
+				failed++
+				continue
+			}
+			linked++
+			reclaimed += c.size
+			// The path now shows the kept copy's times, so record them to keep
+			// the next rescan from hashing it again.
+			if _, err := db.Exec("UPDATE files SET mtime = ? WHERE computer = ? AND disk_label = ? AND path = ?",
+				keepInfo.ModTime().UnixNano(), computerName, c.diskLabel, c.path); err != nil {
+				fmt.Fprintf(w, "[ERROR] Linked %s but failed to update its row: %v\n", disk.path, err)
+			}
+			a := cleanupAction{computer: computerName, diskLabel: c.diskLabel, action: planHardlink, path: c.path, target: s.keep.path,
+				hashAlgo: algo, hash: s.key, bytes: c.size, rule: s.rule}
+			if err := recordAction(db, a); err != nil {
+				fmt.Fprintf(w, "[ERROR] %v\n", err)
+			}
+			if err := recordResolved(db, computerName, algo, s, c, dedupeHardlink); err != nil {
+				fmt.Fprintf(w, "[ERROR] %v\n", err)
+			}
+		}
+	}
+	return linked, failed, reclaimed
+}
@@ -0,0 +1,30 @@
+package dedupe_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"Duplicate-File-Finder.main/dedupe"
+)
+
+func ExampleRun() {
+	res, err := dedupe.Run(context.Background(), dedupe.Options{
+		Roots:     []string{"/home/me/Pictures", "/mnt/backup/Pictures"},
+		Algorithm: "blake3",
+		OnProgress: func(p dedupe.Progress) {
+			log.Printf("%s: %d of %d files", p.Stage, p.Files, p.Total)
+		},
+		OnGroup: func(g dedupe.Group) {
+			fmt.Printf("%d copies of %d bytes: %v\n", len(g.Paths), g.Size, g.Paths)
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var reclaimable int64
+	for _, g := range res.Groups {
+		reclaimable += g.Reclaimable()
+	}
+	fmt.Printf("%d files, %d bytes reclaimable\n", res.Files, reclaimable)
+}
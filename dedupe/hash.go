@@ -0,0 +1,83 @@
+// Package dedupe finds duplicate files. It walks directory trees, groups the
+// files by size, and confirms each candidate with a quick hash of its first
+// bytes and then a hash of its whole content. It is the engine behind the dff
+// command, and other programs can embed it through Run.
+package dedupe
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+// DefaultAlgorithm is the content hash used when none is chosen.
+const DefaultAlgorithm = "sha256"
+
+// QuickHashSize is how much of a file the quick hash covers. Files no larger
+// than this are fully compared by the quick hash alone.
+const QuickHashSize = 64 << 10
+
+const bufferSize = 1 << 20
+
+// algorithms are the supported content hashes. xxh3 and blake3 are much
+// faster than SHA-256 on large files; xxh3 is not cryptographic, which is fine
+// for finding duplicates on your own disks.
+var algorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+	"xxh3":   func() hash.Hash { return xxh3.New() },
+}
+
+// Algorithms returns the names of the supported content hashes, sorted.
+func Algorithms() []string {
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckAlgorithm returns an error unless name is one of Algorithms.
+func CheckAlgorithm(name string) error {
+	if _, ok := algorithms[name]; !ok {
+		return fmt.Errorf("unknown hash algorithm %q (available: %s)", name, strings.Join(Algorithms(), ", "))
+	}
+	return nil
+}
+
+// NewHash returns a new hash.Hash computing algo, which must be one of
+// Algorithms.
+func NewHash(algo string) (hash.Hash, error) {
+	if err := CheckAlgorithm(algo); err != nil {
+		return nil, err
+	}
+	return algorithms[algo](), nil
+}
+
+// Hash returns the hex digest of what r yields, using algo. A positive limit
+// hashes only that many leading bytes.
+func Hash(r io.Reader, algo string, limit int64) (string, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return "", err
+	}
+	bufSize := int64(bufferSize)
+	if limit > 0 {
+		r = io.LimitReader(r, limit)
+		bufSize = min(bufSize, limit)
+	}
+	if _, err := io.CopyBuffer(h, r, make([]byte, bufSize)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,345 @@
+package dedupe
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Options configures Run. Only Roots is required. The callbacks are never
+// called concurrently, and always from the goroutine that called Run, so they
+// can update state without locking; the engine waits for them, so they should
+// return quickly.
+type Options struct {
+	// Roots are the directories to search. A file reached through more than
+	// one root is counted once.
+	Roots []string
+	// Algorithm is the content hash, one of Algorithms. It defaults to
+	// DefaultAlgorithm.
+	Algorithm string
+	// MinSize leaves out files smaller than this many bytes. Empty files are
+	// always left out.
+	MinSize int64
+	// Workers is how many files are hashed at once. It defaults to the number
+	// of CPUs, at most 8.
+	Workers int
+	// Skip, when set, is asked about every file and directory under the
+	// roots. Returning true leaves it out, and for a directory everything
+	// under it too.
+	Skip func(path string, d fs.DirEntry) bool
+	// OnProgress, when set, is called as each stage goes along and once more
+	// when it ends.
+	OnProgress func(Progress)
+	// OnGroup, when set, is called with each duplicate group as soon as it is
+	// confirmed, while Run carries on with the rest.
+	OnGroup func(Group)
+}
+
+// Stage is one of the passes Run makes.
+type Stage string
+
+const (
+	// StageWalk lists the files under the roots.
+	StageWalk Stage = "walk"
+	// StageQuickHash hashes the first QuickHashSize bytes of every file that
+	// shares its size with another.
+	StageQuickHash Stage = "quick hash"
+	// StageFullHash hashes the whole of every file whose quick hash also
+	// matches another's.
+	StageFullHash Stage = "full hash"
+)
+
+// Progress reports how far a stage has got.
+type Progress struct {
+	Stage Stage
+	// Files is how many files the stage has listed or hashed so far.
+	Files int
+	// Total is how many files a hashing stage has to hash, and 0 while walking.
+	Total int
+	// Bytes is how much a hashing stage has read so far, or the total size
+	// of the files the walk has listed.
+	Bytes int64
+}
+
+// Group is a set of files with the same size and content.
+type Group struct {
+	Algorithm string
+	Hash      string
+	Size      int64
+	// Paths are the copies, sorted.
+	Paths []string
+}
+
+// Reclaimable is the space freed by keeping one copy.
+func (g Group) Reclaimable() int64 {
+	return g.Size * int64(len(g.Paths)-1)
+}
+
+// Results is what Run found.
+type Results struct {
+	// Files is how many files were listed.
+	Files int
+	// Hashed is how many hashes were computed, counting both stages.
+	Hashed int
+	// Groups are the duplicate groups, most reclaimable space first.
+	Groups []Group
+	// Errors are the files and directories that couldn't be read. They are
+	// left out rather than stopping the run.
+	Errors []error
+}
+
+// progressEvery is how many files go by between progress callbacks.
+const progressEvery = 1000
+
+// Run finds the duplicate files under opts.Roots. It returns an error for
+// invalid options, or the context's error with what was found so far when ctx
+// ends first.
+func Run(ctx context.Context, opts Options) (Results, error) {
+	if len(opts.Roots) == 0 {
+		return Results{}, errors.New("no roots to search")
+	}
+	if opts.Algorithm == "" {
+		opts.Algorithm = DefaultAlgorithm
+	}
+	if err := CheckAlgorithm(opts.Algorithm); err != nil {
+		return Results{}, err
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = min(runtime.NumCPU(), 8)
+	}
+	r := &runner{opts: opts}
+
+	bySize := r.walk(ctx)
+	if ctx.Err() != nil {
+		return r.results, ctx.Err()
+	}
+	// Larger files first, so the groups that free the most space tend to
+	// come out first.
+	var candidates []class
+	for size, paths := range bySize {
+		if len(paths) > 1 {
+			candidates = append(candidates, class{size, paths})
+		}
+	}
+	sortClasses(candidates)
+
+	var full []class
+	r.hashClasses(ctx, StageQuickHash, candidates, QuickHashSize, func(size int64, byHash map[string][]string) {
+		for sum, paths := range byHash {
+			switch {
+			case len(paths) < 2:
+			case size <= QuickHashSize:
+				r.found(Group{Algorithm: opts.Algorithm, Hash: sum, Size: size, Paths: paths})
+			default:
+				full = append(full, class{size, paths})
+			}
+		}
+	})
+	if ctx.Err() != nil {
+		return r.results, ctx.Err()
+	}
+	sortClasses(full)
+	r.hashClasses(ctx, StageFullHash, full, 0, func(size int64, byHash map[string][]string) {
+		for sum, paths := range byHash {
+			if len(paths) > 1 {
+				r.found(Group{Algorithm: opts.Algorithm, Hash: sum, Size: size, Paths: paths})
+			}
+		}
+	})
+
+	slices.SortFunc(r.results.Groups, func(a, b Group) int {
+		if c := cmp.Compare(b.Reclaimable(), a.Reclaimable()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Hash, b.Hash)
+	})
+	return r.results, ctx.Err()
+}
+
+// class is a set of files that might be duplicates of each other.
+type class struct {
+	size  int64
+	paths []string
+}
+
+func sortClasses(classes []class) {
+	slices.SortFunc(classes, func(a, b class) int {
+		if c := cmp.Compare(b.size, a.size); c != 0 {
+			return c
+		}
+		return strings.Compare(a.paths[0], b.paths[0])
+	})
+}
+
+type runner struct {
+	opts    Options
+	results Results
+}
+
+func (r *runner) progress(p Progress, last bool) {
+	if r.opts.OnProgress != nil && (last || p.Files%progressEvery == 0) {
+		r.opts.OnProgress(p)
+	}
+}
+
+func (r *runner) found(g Group) {
+	slices.Sort(g.Paths)
+	r.results.Groups = append(r.results.Groups, g)
+	if r.opts.OnGroup != nil {
+		r.opts.OnGroup(g)
+	}
+}
+
+// walk lists the regular files under the roots by size. Symbolic links are
+// left out, so a link is never reported as a copy of its target.
+func (r *runner) walk(ctx context.Context) map[int64][]string {
+	bySize := map[int64][]string{}
+	seen := map[string]bool{}
+	var bytes int64
+	for _, root := range r.opts.Roots {
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				r.results.Errors = append(r.results.Errors, err)
+				return nil
+			}
+			if r.opts.Skip != nil && r.opts.Skip(path, d) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || seen[path] {
+				return nil
+			}
+			seen[path] = true
+			info, err := d.Info()
+			if err != nil {
+				r.results.Errors = append(r.results.Errors, err)
+				return nil
+			}
+			r.results.Files++
+			bytes += info.Size()
+			r.progress(Progress{Stage: StageWalk, Files: r.results.Files, Bytes: bytes}, false)
+			if info.Size() > 0 && info.Size() >= r.opts.MinSize {
+				bySize[info.Size()] = append(bySize[info.Size()], path)
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	r.progress(Progress{Stage: StageWalk, Files: r.results.Files, Bytes: bytes}, true)
+	return bySize
+}
+
+// hashClasses hashes every file of classes, limit bytes of each when limit is
+// positive, and calls done with a class's files grouped by hash as soon as
+// the last of them is hashed. Files that can't be read are left out.
+func (r *runner) hashClasses(ctx context.Context, stage Stage, classes []class, limit int64, done func(size int64, byHash map[string][]string)) {
+	type job struct {
+		class int
+		path  string
+	}
+	type result struct {
+		job
+		sum string
+		err error
+	}
+	total := 0
+	left := make([]int, len(classes))
+	for i, c := range classes {
+		total += len(c.paths)
+		left[i] = len(c.paths)
+	}
+	if total == 0 {
+		return
+	}
+
+	jobs := make(chan job)
+	results := make(chan result)
+	var bytesRead atomic.Int64
+	var hashers sync.WaitGroup
+	for range r.opts.Workers {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+			for j := range jobs {
+				sum, err := hashFile(j.path, r.opts.Algorithm, limit, &bytesRead)
+				results <- result{j, sum, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i, c := range classes {
+			for _, path := range c.paths {
+				select {
+				case jobs <- job{i, path}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		hashers.Wait()
+		close(results)
+	}()
+
+	byHash := make([]map[string][]string, len(classes))
+	hashed := 0
+	for res := range results {
+		hashed++
+		if res.err != nil {
+			r.results.Errors = append(r.results.Errors, res.err)
+		} else {
+			r.results.Hashed++
+			if byHash[res.class] == nil {
+				byHash[res.class] = map[string][]string{}
+			}
+			byHash[res.class][res.sum] = append(byHash[res.class][res.sum], res.path)
+		}
+		r.progress(Progress{Stage: stage, Files: hashed, Total: total, Bytes: bytesRead.Load()}, hashed == total)
+		if left[res.class]--; left[res.class] == 0 {
+			done(classes[res.class].size, byHash[res.class])
+			byHash[res.class] = nil
+		}
+	}
+}
+
+// countingReader adds every byte read to n, for the progress callbacks.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func hashFile(path, algo string, limit int64, bytesRead *atomic.Int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return Hash(countingReader{f, bytesRead}, algo, limit)
+}
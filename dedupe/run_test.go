@@ -0,0 +1,93 @@
+package dedupe
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestRun(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), QuickHashSize+10)
+	// Same size and first QuickHashSize bytes as large, different after.
+	almost := append(bytes.Repeat([]byte("x"), QuickHashSize), []byte("yyyyyyyyyy")...)
+	root := writeFiles(t, map[string][]byte{
+		"a.txt":       []byte("hello"),
+		"sub/b.txt":   []byte("hello"),
+		"c.txt":       []byte("world"),
+		"empty1":      nil,
+		"empty2":      nil,
+		"big/one":     large,
+		"big/two":     large,
+		"big/almost":  almost,
+		"skip/a.txt":  []byte("hello"),
+		"other/d.txt": []byte("12345678"),
+	})
+
+	var streamed []Group
+	var stages []Stage
+	res, err := Run(context.Background(), Options{
+		Roots:      []string{root, filepath.Join(root, "sub")},
+		Algorithm:  "xxh3",
+		Workers:    2,
+		Skip:       func(path string, _ os.DirEntry) bool { return filepath.Base(path) == "skip" },
+		OnGroup:    func(g Group) { streamed = append(streamed, g) },
+		OnProgress: func(p Progress) { stages = append(stages, p.Stage) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 9 {
+		t.Errorf("Files = %d, want 9", res.Files)
+	}
+	want := [][]string{
+		{filepath.Join(root, "big/one"), filepath.Join(root, "big/two")},
+		{filepath.Join(root, "a.txt"), filepath.Join(root, "sub/b.txt")},
+	}
+	if len(res.Groups) != len(want) {
+		t.Fatalf("got %d groups, want %d: %v", len(res.Groups), len(want), res.Groups)
+	}
+	for i, g := range res.Groups {
+		if !slices.Equal(g.Paths, want[i]) || g.Algorithm != "xxh3" {
+			t.Errorf("group %d = %v, want paths %v", i, g, want[i])
+		}
+	}
+	if len(streamed) != len(res.Groups) {
+		t.Errorf("OnGroup saw %d groups, want %d", len(streamed), len(res.Groups))
+	}
+	if !slices.Equal(slices.Compact(stages), []Stage{StageWalk, StageQuickHash, StageFullHash}) {
+		t.Errorf("stages = %v", slices.Compact(stages))
+	}
+}
+
+func TestRunRejectsUnknownAlgorithm(t *testing.T) {
+	if _, err := Run(context.Background(), Options{Roots: []string{t.TempDir()}, Algorithm: "md5"}); err == nil {
+		t.Error("Run accepted md5")
+	}
+}
+
+func TestRunStopsWhenCanceled(t *testing.T) {
+	root := writeFiles(t, map[string][]byte{"a": []byte("x"), "b": []byte("x")})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Run(ctx, Options{Roots: []string{root}}); err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// addCopy writes content to path and records it on computer pc with hash h,
+// as a scan and hash would.
+func addCopy(t *testing.T, db *sql.DB, diskLabel, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO files(computer, disk_label, path, size, mtime, hash, hash_algo) VALUES('pc', ?, ?, ?, ?, 'h', 'sha256')`,
+		diskLabel, path, info.Size(), info.ModTime().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanHardlinkSplitsUnlabelledVolumes(t *testing.T) {
+	a := t.TempDir()
+	b, err := os.MkdirTemp("/dev/shm", "dff")
+	if err != nil {
+		t.Skip("no second volume to test with")
+	}
+	t.Cleanup(func() { os.RemoveAll(b) })
+	va, errA := volumeOf(a)
+	vb, errB := volumeOf(b)
+	if errA != nil || errB != nil || va == vb {
+		t.Skip("no second volume to test with")
+	}
+
+	db := testDB(t)
+	for _, path := range []string{filepath.Join(a, "1"), filepath.Join(a, "2"), filepath.Join(b, "1"), filepath.Join(b, "2")} {
+		addCopy(t, db, "", path, "same")
+	}
+	plan, _, err := planDedupe(db, "pc", "sha256", keepShortestPath, "", dedupeHardlink, sidecarConfig{}, protectedPaths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 2 {
+		t.Fatalf("got %d sets, want one per volume", len(plan))
+	}
+	for _, s := range plan {
+		keepVolume, _ := volumeOf(s.keep.path)
+		for _, c := range s.remove {
+			if v, _ := volumeOf(c.path); v != keepVolume {
+				t.Errorf("%s would be linked to %s on another volume", c.path, s.keep.path)
+			}
+		}
+	}
+}
+
+func TestPlanKeepsCreatedFirst(t *testing.T) {
+	dir := t.TempDir()
+	db := testDB(t)
+	paths := []string{filepath.Join(dir, "copy"), filepath.Join(dir, "original"), filepath.Join(dir, "unknown")}
+	for _, path := range paths {
+		addCopy(t, db, "C", path, "same")
+	}
+	for path, created := range map[string]int64{paths[0]: 200, paths[1]: 100} {
+		if _, err := db.Exec(`UPDATE files SET created = ? WHERE path = ?`, created, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One copy's creation time is unknown, so the rule can't decide.
+	plan, undecided, err := planDedupe(db, "pc", "sha256", keepCreatedFirst, "", dedupeDelete, sidecarConfig{}, protectedPaths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 0 || len(undecided) != 1 {
+		t.Fatalf("got %d sets and %d undecided, want the set undecided", len(plan), len(undecided))
+	}
+
+	if _, err := db.Exec(`UPDATE files SET created = 300 WHERE path = ?`, paths[2]); err != nil {
+		t.Fatal(err)
+	}
+	plan, _, err = planDedupe(db, "pc", "sha256", keepCreatedFirst, "", dedupeDelete, sidecarConfig{}, protectedPaths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 1 || plan[0].keep.path != paths[1] {
+		t.Fatalf("got %+v, want %s kept", plan, paths[1])
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/message"
+)
+
+// duplicateFile is one copy in a duplicate set.
+type duplicateFile struct {
+	computer, diskLabel, path string
+	created                   int64 // Unix nanoseconds, 0 when unknown
+}
+
+// duplicateSet is a group of files believed to hold the same content.
+type duplicateSet struct {
+	size  int64
+	key   string // content hash, or the shared file name for unhashed sets
+	files []duplicateFile
+}
+
+func (s duplicateSet) waste() int64 { return s.size * int64(len(s.files)-1) }
+
+// duplicateReport accumulates sets and the space they waste per drive. The
+// first copy of each set is treated as the one to keep; every later copy
+// counts against its own drive, together with its sidecars when they move
+// with it. Size-only sets are listed but kept out of those totals, and only
+// counted in their own.
+type duplicateReport struct {
+	w                            io.Writer
+	p                            *message.Printer
+	db                           *sql.DB
+	anon                         *anonymizer
+	sidecars                     sidecarConfig
+	listed                       int64
+	sets, redundant, reclaimable int64
+	sizeOnlySets, sizeOnlyBytes  int64
+	perDrive                     map[string]int64
+}
+
+// add prints one set and adds it to the totals, or to the size-only totals
+// when sizeOnly is set. It queries the database for sidecars, so no other
+// result set may be open.
+func (r *duplicateReport) add(s duplicateSet, heading string, sizeOnly bool) error {
+	waste := s.waste()
+	lines := make([][]string, len(s.files))
+	extra := make([]int64, len(s.files))
+	for i, f := range s.files {
+		found, err := r.sidecars.findSidecars(r.db, f.computer, f.diskLabel, f.path)
+		if err != nil {
+			return err
+		}
+		for _, sc := range found {
+			if r.sidecars.Action == sidecarsWarn {
+				lines[i] = append(lines[i], fmt.Sprintf("      ! sidecar stays behind if this copy is removed: %s", r.anon.path(sc.path)))
+				continue
+			}
+			lines[i] = append(lines[i], fmt.Sprintf("      + sidecar %s (%s bytes)", r.anon.path(sc.path), r.p.Sprint(sc.size)))
+			extra[i] += sc.size
+		}
+	}
+
+	for _, e := range extra[1:] {
+		waste += e
+	}
+	r.listed++
+	if sizeOnly {
+		r.sizeOnlySets++
+		r.sizeOnlyBytes += waste
+	} else {
+		r.sets++
+		r.redundant += int64(len(s.files) - 1)
+		r.reclaimable += waste
+	}
+	r.p.Fprintf(r.w, "\nDuplicate set %d: %d copies of %d bytes, %d bytes reclaimable (%s)\n", r.listed, len(s.files), s.size, waste, heading)
+	for i, f := range s.files {
+		drive := fmt.Sprintf("[%s] [%s]", r.anon.computer(f.computer), r.anon.path(f.diskLabel))
+		fmt.Fprintf(r.w, "  %s %s\n", drive, r.anon.path(f.path))
+		for _, line := range lines[i] {
+			fmt.Fprintln(r.w, line)
+		}
+		if i > 0 && !sizeOnly {
+			r.perDrive[drive] += s.size + extra[i]
+		}
+	}
+	return nil
+}
+
+// Headings for the duplicate sets that aren't confirmed by a content hash.
+const (
+	unhashedHeading = "same size and name, not verified by hash"
+	privateHeading  = "same size only, privacy zone never hashed; check by hand"
+)
+
+// duplicateSets returns every set of files, across all computers and disks in
+// the database, that share a content hash and size, largest waste first. Only
+// hashes produced by algo are compared; rows hashed with any other algorithm
+// are left out. Files that were never hashed are grouped by size and file name
+// instead, and files in privacy zones are matched on size alone; those two
+// kinds come back separately. The copies of a hashed or unhashed set are in
+// paths order.
+func duplicateSets(db *sql.DB, algo string, paths *pathOrder) (hashed, unhashed, private []duplicateSet, err error) {
+	rows, err := db.Query(`WITH groups AS (
+			SELECT hash, size, COUNT(*) AS copies FROM files
+			WHERE hash IS NOT NULL AND hash_algo = ? AND removed_at IS NULL GROUP BY hash, size HAVING COUNT(*) > 1
+		)
+		SELECT f.hash, f.size, COALESCE(f.computer, ''), COALESCE(f.disk_label, ''), f.path
+		FROM files f JOIN groups g ON f.hash = g.hash AND f.size = g.size
+		WHERE f.hash_algo = ? AND f.removed_at IS NULL
+		ORDER BY f.size * (g.copies - 1) DESC, f.hash, f.path`, algo, algo)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to query duplicates: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		var size int64
+		var f duplicateFile
+		if err := rows.Scan(&hash, &size, &f.computer, &f.diskLabel, &f.path); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if len(hashed) == 0 || hashed[len(hashed)-1].key != hash {
+			hashed = append(hashed, duplicateSet{size: size, key: hash})
+		}
+		hashed[len(hashed)-1].files = append(hashed[len(hashed)-1].files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, fmt.Errorf("row iteration error: %v", err)
+	}
+	rows.Close()
+
+	if unhashed, err = unhashedDuplicates(db); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, s := range hashed {
+		paths.sortFiles(s.files)
+	}
+	for _, s := range unhashed {
+		paths.sortFiles(s.files)
+	}
+	if private, err = privateDuplicates(db, algo); err != nil {
+		return nil, nil, nil, err
+	}
+	return hashed, unhashed, private, nil
+}
+
+// printDuplicates lists the duplicate sets from duplicateSets, with a warning
+// counting the files hashed with an algorithm other than algo, and the space
+// each drive would get back. Unhashed and privacy zone sets are marked as
+// unverified. Names are passed through anon, which may be nil, and each
+// copy's sidecars are listed according to sidecars.
+func printDuplicates(db *sql.DB, w io.Writer, algo string, anon *anonymizer, sidecars sidecarConfig, paths *pathOrder) error {
+	var otherAlgo int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE hash IS NOT NULL AND hash_algo IS NOT ? AND removed_at IS NULL", algo).Scan(&otherAlgo); err != nil {
+		return fmt.Errorf("failed to check hash algorithms: %v", err)
+	}
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	if otherAlgo > 0 {
+		p.Fprintf(w, "Warning: %d files were hashed with an algorithm other than %s and are not compared; rescan their drives to re-hash them.\n", otherAlgo, algo)
+	}
+	report := &duplicateReport{w: w, p: p, db: db, anon: anon, sidecars: sidecars, perDrive: map[string]int64{}}
+
+	// Sets are collected before printing because sidecar lookups need the
+	// single database connection the queries hold.
+	hashed, unhashed, private, err := duplicateSets(db, algo, paths)
+	if err != nil {
+		return err
+	}
+	for _, s := range hashed {
+		heading := fmt.Sprintf("%s %s", algo, s.key[:min(16, len(s.key))])
+		if sampled, ok := strings.CutPrefix(s.key, samplePrefix); ok {
+			heading = fmt.Sprintf("%s sample %s, not every byte compared", algo, sampled[:min(16, len(sampled))])
+		}
+		if err := report.add(s, heading, false); err != nil {
+			return err
+		}
+	}
+	for _, s := range unhashed {
+		if err := report.add(s, unhashedHeading, false); err != nil {
+			return err
+		}
+	}
+	for _, s := range private {
+		if err := report.add(s, privateHeading, true); err != nil {
+			return err
+		}
+	}
+
+	if report.listed == 0 {
+		fmt.Fprintln(w, "No duplicate files found.")
+		return printScanFilters(db, w, anon)
+	}
+	p.Fprintf(w, "\nReclaimable space by drive:\n")
+	drives := make([]string, 0, len(report.perDrive))
+	for d := range report.perDrive {
+		drives = append(drives, d)
+	}
+	sort.Slice(drives, func(i, j int) bool {
+		if report.perDrive[drives[i]] != report.perDrive[drives[j]] {
+			return report.perDrive[drives[i]] > report.perDrive[drives[j]]
+		}
+		return drives[i] < drives[j]
+	})
+	for _, d := range drives {
+		p.Fprintf(w, "  %s %d bytes\n", d, report.perDrive[d])
+	}
+	p.Fprintf(w, "\n%d duplicate sets, %d redundant copies, %d bytes reclaimable.\n", report.sets, report.redundant, report.reclaimable)
+	if report.sizeOnlySets > 0 {
+		p.Fprintf(w, "Unverified: %d more sets in privacy zones match on size only, %d bytes if they are duplicates.\n", report.sizeOnlySets, report.sizeOnlyBytes)
+	}
+	return printScanFilters(db, w, anon)
+}
+
+// unhashedDuplicates groups files that were never examined by the hashing
+// passes (scanned with -hash=false, or imported without hashes) by size and
+// case-insensitive file name, largest waste first.
+func unhashedDuplicates(db *sql.DB) ([]duplicateSet, error) {
+	rows, err := db.Query(`SELECT size, COALESCE(computer, ''), COALESCE(disk_label, ''), path FROM files
+		WHERE hash IS NULL AND quick_hash IS NULL AND size > 0 AND private = 0 AND removed_at IS NULL AND size IN (
+			SELECT size FROM files WHERE hash IS NULL AND quick_hash IS NULL AND size > 0 AND private = 0 AND removed_at IS NULL
+			GROUP BY size HAVING COUNT(*) > 1)
+		ORDER BY size, path`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unhashed files: %v", err)
+	}
+	defer rows.Close()
+	type nameKey struct {
+		size int64
+		name string
+	}
+	groups := map[nameKey]*duplicateSet{}
+	var order []nameKey
+	for rows.Next() {
+		var size int64
+		var f duplicateFile
+		if err := rows.Scan(&size, &f.computer, &f.diskLabel, &f.path); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		// Paths may come from other computers, so split on either separator.
+		name := strings.ToLower(f.path[strings.LastIndexAny(f.path, `/\`)+1:])
+		k := nameKey{size, name}
+		if groups[k] == nil {
+			groups[k] = &duplicateSet{size: size, key: name}
+			order = append(order, k)
+		}
+		groups[k].files = append(groups[k].files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %v", err)
+	}
+	var sets []duplicateSet
+	for _, k := range order {
+		if s := groups[k]; len(s.files) > 1 {
+			sets = append(sets, *s)
+		}
+	}
+	sort.SliceStable(sets, func(i, j int) bool { return sets[i].waste() > sets[j].waste() })
+	return sets, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readFileList reads one path per line from the file at path, or from stdin
+// when path is "-". Blank lines are skipped, and surrounding quotes (as written
+// by PowerShell or robocopy) are dropped. Relative paths are made absolute.
+func readFileList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file list: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := strings.Trim(strings.TrimSpace(scanner.Text()), `"`)
+		if line == "" {
+			continue
+		}
+		abs, err := filepath.Abs(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %v", line, err)
+		}
+		paths = append(paths, abs)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file list: %v", err)
+	}
+	return paths, nil
+}
+
+// containingDrive returns the drive that contains path, choosing the innermost
+// one when mount points are nested, or "" when none does.
+func containingDrive(drives []string, path string) string {
+	owner := ""
+	for _, d := range drives {
+		if subtreeContains(d, path) && len(d) > len(owner) {
+			owner = d
+		}
+	}
+	return owner
+}
+
+// assignToDrives groups paths by the drive that contains them. Paths on none
+// of the drives are returned separately.
+func assignToDrives(paths, drives []string) (map[string][]string, []string) {
+	byDrive := map[string][]string{}
+	var unmatched []string
+	for _, p := range paths {
+		owner := containingDrive(drives, p)
+		if owner == "" {
+			unmatched = append(unmatched, p)
+			continue
+		}
+		byDrive[owner] = append(byDrive[owner], p)
+	}
+	return byDrive, unmatched
+}
+
+// recordFileList records each listed path the way walkFiles records a walked
+// entry, without descending into directories.
+func recordFileList(ctx context.Context, paths []string, record fileRecorder, progress *driveProgress, skip walkFilter) (int, error) {
+	count := 0
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		endStat := phases.track(phaseStat)
+		info, err := os.Lstat(path)
+		endStat()
+		if err != nil {
+			progress.addError("stat", err)
+			continue
+		}
+		if skip.skips(path, info.IsDir()) || info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		e := walkedEntry{path: path}
+		if !info.IsDir() {
+			if e = statEntry(path, info); skip.skipsModified(e.mtime) {
+				continue
+			}
+		}
+		endInsert := phases.track(phaseInsert)
+		err = record(e)
+		endInsert()
+		if err != nil {
+			progress.addError("insert", err)
+			progress.logf("[ERROR] Failed to insert or update %s: %v\n", path, err)
+			continue
+		}
+		count++
+		progress.files.Store(int64(count))
+	}
+	return count, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// scansSchema records each walk and the filters it ran with, so reports can
+// say what was left out of the index. Files point at the last scan that saw
+// them. A later migration adds the columns finishScan fills in.
+const scansSchema = `
+CREATE TABLE IF NOT EXISTS scans (
+	id INTEGER PRIMARY KEY,
+	started_at TEXT NOT NULL,
+	computer TEXT,
+	disk_label TEXT,
+	root TEXT NOT NULL,
+	include TEXT NOT NULL DEFAULT '',
+	exclude TEXT NOT NULL DEFAULT ''
+);`
+
+// patternList is a repeatable flag holding -include or -exclude patterns.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *patternList) Set(value string) error {
+	if _, err := compilePattern(value); err != nil {
+		return err
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// dateFlag is a -modified-after or -modified-before bound, given as a date
+// (midnight local time) or an RFC 3339 time. The zero value is no bound.
+type dateFlag struct {
+	time.Time
+}
+
+func (d *dateFlag) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format(time.RFC3339)
+}
+
+func (d *dateFlag) Set(value string) error {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		d.Time = t
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid date %q (want YYYY-MM-DD or an RFC 3339 time)", value)
+	}
+	d.Time = t
+	return nil
+}
+
+// pathPattern is a glob matched against an entry's name, or with a "re:"
+// prefix a regular expression matched against its whole path. Both see '/' as
+// the separator, and globs ignore case on Windows.
+type pathPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compilePattern(s string) (pathPattern, error) {
+	if expr, ok := strings.CutPrefix(s, "re:"); ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return pathPattern{}, fmt.Errorf("invalid regular expression %q: %v", expr, err)
+		}
+		return pathPattern{re: re}, nil
+	}
+	if runtime.GOOS == "windows" {
+		s = strings.ToLower(s)
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return pathPattern{}, fmt.Errorf("invalid pattern %q: %v", s, err)
+	}
+	return pathPattern{glob: s}, nil
+}
+
+func (p pathPattern) matches(entry string) bool {
+	entry = filepath.ToSlash(entry)
+	if p.re != nil {
+		return p.re.MatchString(entry)
+	}
+	name := path.Base(entry)
+	if runtime.GOOS == "windows" {
+		name = strings.ToLower(name)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+// walkFilter decides which entries a walk leaves out: the tool's own files,
+// anything matching an exclude pattern (a directory is skipped with all its
+// contents), and, when include patterns are given, files matching none of
+// them. Directories are always walked unless excluded. Files modified outside
+// the after/before range are left out once their times are known.
+type walkFilter struct {
+	artifacts        artifactSet
+	include, exclude []pathPattern
+	after, before    time.Time
+}
+
+func newWalkFilter(artifacts artifactSet, include, exclude []string, after, before time.Time) walkFilter {
+	f := walkFilter{artifacts: artifacts, after: after, before: before}
+	for _, s := range include {
+		p, _ := compilePattern(s)
+		f.include = append(f.include, p)
+	}
+	for _, s := range exclude {
+		p, _ := compilePattern(s)
+		f.exclude = append(f.exclude, p)
+	}
+	return f
+}
+
+// with returns a copy of the filter that also skips paths.
+func (f walkFilter) with(paths ...string) walkFilter {
+	f.artifacts = f.artifacts.with(paths...)
+	return f
+}
+
+func (f walkFilter) skips(path string, isDir bool) bool {
+	if f.artifacts.contains(path) {
+		return true
+	}
+	for _, p := range f.exclude {
+		if p.matches(path) {
+			return true
+		}
+	}
+	if isDir || len(f.include) == 0 {
+		return false
+	}
+	for _, p := range f.include {
+		if p.matches(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipsModified reports whether a file modified at mtime (Unix nanoseconds) is
+// before after or not before before.
+func (f walkFilter) skipsModified(mtime int64) bool {
+	t := time.Unix(0, mtime)
+	return !f.after.IsZero() && t.Before(f.after) || !f.before.IsZero() && !t.Before(f.before)
+}
+
+// skipsAncestor reports whether a directory between root and path is skipped,
+// so a walk from root would never have reached path.
+func (f walkFilter) skipsAncestor(root, path string) bool {
+	for dir := filepath.Dir(path); subtreeContains(root, dir) && !subtreeContains(dir, root); dir = filepath.Dir(dir) {
+		if f.skips(dir, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// startScan records a walk of root with the patterns and modification date
+// range it is about to use and returns its id.
+func startScan(db *sql.DB, computerName, diskLabel, root string, include, exclude []string, after, before dateFlag) (int64, error) {
+	res, err := db.Exec(`INSERT INTO scans(started_at, computer, disk_label, root, include, exclude, modified_after, modified_before)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().UTC().Format(time.RFC3339), computerName, diskLabel, root, strings.Join(include, "\n"), strings.Join(exclude, "\n"),
+		after.String(), before.String())
+	if err != nil {
+		return 0, fmt.Errorf("failed to record scan: %v", err)
+	}
+	return res.LastInsertId()
+}
+
+// finishScan records that the walk with id completed, having recorded files
+// entries and hit errors failures. total_bytes sums the files that now point
+// at the scan.
+func finishScan(db *sql.DB, id int64, files, errors int64) error {
+	_, err := db.Exec(`UPDATE scans SET finished_at = ?, file_count = ?, error_count = ?,
+		total_bytes = (SELECT COALESCE(SUM(size), 0) FROM files WHERE scan_id = ?4) WHERE id = ?4`,
+		time.Now().UTC().Format(time.RFC3339), files, errors, id)
+	if err != nil {
+		return fmt.Errorf("failed to record scan end: %v", err)
+	}
+	return nil
+}
+
+// printScanFilters lists the roots whose most recent walk was filtered, so a
+// report doesn't read as covering files that were never indexed.
+func printScanFilters(db *sql.DB, w io.Writer, anon *anonymizer) error {
+	rows, err := db.Query(`SELECT COALESCE(computer, ''), COALESCE(disk_label, ''), root, include, exclude, modified_after, modified_before FROM scans s
+		WHERE id = (SELECT MAX(id) FROM scans t WHERE t.computer IS s.computer AND t.disk_label IS s.disk_label AND t.root = s.root)
+		AND (include != '' OR exclude != '' OR modified_after != '' OR modified_before != '')
+		ORDER BY computer, disk_label, root`)
+	if err != nil {
+		return fmt.Errorf("failed to query scans: %v", err)
+	}
+	defer rows.Close()
+	header := false
+	for rows.Next() {
+		var computerName, diskLabel, root, include, exclude, after, before string
+		if err := rows.Scan(&computerName, &diskLabel, &root, &include, &exclude, &after, &before); err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+		if !header {
+			fmt.Fprintln(w, "\nFiltered scans (skipped files are not in this report):")
+			header = true
+		}
+		fmt.Fprintf(w, "  [%s] [%s] %s", anon.computer(computerName), anon.path(diskLabel), anon.path(root))
+		if exclude != "" {
+			fmt.Fprintf(w, " excluding %s", strings.ReplaceAll(exclude, "\n", ", "))
+		}
+		if include != "" {
+			fmt.Fprintf(w, " including only %s", strings.ReplaceAll(include, "\n", ", "))
+		}
+		if after != "" {
+			fmt.Fprintf(w, " modified on or after %s", after)
+		}
+		if before != "" {
+			fmt.Fprintf(w, " modified before %s", before)
+		}
+		fmt.Fprintln(w)
+	}
+	return rows.Err()
+}
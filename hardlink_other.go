@@ -0,0 +1,54 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// volumeOf identifies the filesystem holding path by its device number. Only
+// files on the same filesystem can be hard links to each other.
+func volumeOf(path string) (string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no device number for %s", path)
+	}
+	return fmt.Sprint(st.Dev), nil
+}
+
+// accessBits are the mode bits a hard link shares with every other name of
+// the file.
+const accessBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// sameAccess returns an error unless path has the same owner, group and
+// permission bits as keep. Hard links share all of them, so linking path to
+// keep would change who can read or write it.
+func sameAccess(keep, path string) error {
+	ki, err := os.Lstat(keep)
+	if err != nil {
+		return err
+	}
+	pi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if ki.Mode()&accessBits != pi.Mode()&accessBits {
+		return fmt.Errorf("its permissions %v differ from the kept copy's %v", pi.Mode()&accessBits, ki.Mode()&accessBits)
+	}
+	ks, ok := ki.Sys().(*syscall.Stat_t)
+	ps, ok2 := pi.Sys().(*syscall.Stat_t)
+	if !ok || !ok2 {
+		return errors.New("its owner can't be compared with the kept copy's")
+	}
+	if ks.Uid != ps.Uid || ks.Gid != ps.Gid {
+		return errors.New("its owner or group differs from the kept copy's")
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// volumeOf identifies the volume holding path by its root, so a volume
+// mounted in a folder counts as a volume of its own. Only files on the same
+// volume can be hard links to each other.
+func volumeOf(path string) (string, error) {
+	root, err := volumePathName(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(root), nil
+}
+
+// volumePathName returns the root of the volume holding path, such as C:\ or
+// the folder a volume is mounted in.
+func volumePathName(path string) (string, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	root := make([]uint16, syscall.MAX_PATH+1)
+	ret, _, e1 := syscall.NewLazyDLL("kernel32.dll").NewProc("GetVolumePathNameW").Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&root[0])), uintptr(len(root)))
+	if ret == 0 {
+		return "", fmt.Errorf("failed to find the volume of %s: %v", path, e1)
+	}
+	return syscall.UTF16ToString(root), nil
+}
+
+// Parts of a security descriptor, for GetFileSecurityW.
+const (
+	ownerSecurityInformation = 0x1
+	groupSecurityInformation = 0x2
+	daclSecurityInformation  = 0x4
+)
+
+// sameAccess returns an error unless path has the same owner, group, access
+// control list and read-only, hidden and system attributes as keep. Hard
+// links share all of them, so linking path to keep would change who can read
+// or write it. ACLs are compared as stored, so two that grant the same access
+// in a different order count as different.
+func sameAccess(keep, path string) error {
+	ki, err := os.Lstat(keep)
+	if err != nil {
+		return err
+	}
+	pi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	ka := ki.Sys().(*syscall.Win32FileAttributeData).FileAttributes & recordedAttributes
+	pa := pi.Sys().(*syscall.Win32FileAttributeData).FileAttributes & recordedAttributes
+	if ka != pa {
+		return errors.New("its read-only, hidden or system attributes differ from the kept copy's")
+	}
+	ksd, err := securityDescriptor(keep)
+	if err != nil {
+		return err
+	}
+	psd, err := securityDescriptor(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ksd, psd) {
+		return errors.New("its owner or permissions differ from the kept copy's")
+	}
+	return nil
+}
+
+// securityDescriptor returns the owner, group and DACL of the file at path as
+// a self-relative security descriptor.
+func securityDescriptor(path string) ([]byte, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	getFileSecurity := syscall.NewLazyDLL("advapi32.dll").NewProc("GetFileSecurityW")
+	info := uintptr(ownerSecurityInformation | groupSecurityInformation | daclSecurityInformation)
+	var needed uint32
+	getFileSecurity.Call(uintptr(unsafe.Pointer(name)), info, 0, 0, uintptr(unsafe.Pointer(&needed)))
+	if needed == 0 {
+		return nil, fmt.Errorf("failed to read the permissions of %s", path)
+	}
+	sd := make([]byte, needed)
+	ret, _, e1 := getFileSecurity.Call(uintptr(unsafe.Pointer(name)), info, uintptr(unsafe.Pointer(&sd[0])), uintptr(needed), uintptr(unsafe.Pointer(&needed)))
+	if ret == 0 {
+		return nil, fmt.Errorf("failed to read the permissions of %s: %v", path, e1)
+	}
+	return sd, nil
+}
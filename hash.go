@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"Duplicate-File-Finder.main/dedupe"
+)
+
+// hashBatchSize is how many unhashed rows are loaded at a time. Rows are read
+// in batches because the single database connection can't serve the update
+// statements while a long result set is still open.
+const hashBatchSize = 1000
+
+// countingReader adds every byte read to n, for the throughput display.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// hashFile returns the hex digest of the file's contents using algo, and its
+// creation time read from the open handle (0 where unavailable). A positive
+// limit hashes only that many leading bytes.
+func hashFile(path, algo string, limit int64, bytesRead *atomic.Int64) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	created := fileCreated(f)
+	sum, err := dedupe.Hash(countingReader{f, bytesRead}, algo, limit)
+	if err != nil {
+		return "", 0, err
+	}
+	return sum, created, nil
+}
+
+// hashStage is one pass of the candidate filter.
+type hashStage int
+
+const (
+	// stageQuick hashes the first dedupe.QuickHashSize bytes of files whose
+	// size matches some other file in the database.
+	stageQuick hashStage = iota
+	// stageFull hashes whole files whose quick hash also matches another file,
+	// or matches the size of a file that only has a full hash (manifest rows).
+	stageFull
+)
+
+var pendingHashQueries = [...]string{
+	stageQuick: `SELECT id, path, size FROM files
+		WHERE computer = ? AND disk_label = ? AND substr(path, 1, ?) = ?
+		AND quick_hash IS NULL AND size > 0 AND private = 0 AND removed_at IS NULL AND id > ?
+		AND (? OR EXISTS (SELECT 1 FROM files o WHERE o.size = files.size AND o.id != files.id AND o.removed_at IS NULL))
+		ORDER BY id LIMIT ?`,
+	stageFull: `SELECT id, path, size FROM files
+		WHERE computer = ? AND disk_label = ? AND substr(path, 1, ?) = ?
+		AND hash IS NULL AND quick_hash IS NOT NULL AND size > 0 AND private = 0 AND removed_at IS NULL AND id > ?
+		AND (? OR EXISTS (SELECT 1 FROM files o WHERE o.size = files.size AND o.id != files.id AND o.removed_at IS NULL
+			AND (o.quick_hash = files.quick_hash OR (o.quick_hash IS NULL AND o.hash IS NOT NULL))))
+		ORDER BY id LIMIT ?`,
+}
+
+type pendingHash struct {
+	id   int64
+	path string
+	size int64
+}
+
+// nextPendingHashes returns up to limit rows under root on the given computer
+// and disk that still need hashing in stage, with ids above afterID. With all
+// set, every file is pending, whether or not it collides with another. Empty
+// files and directories (size 0) are never hashed.
+func nextPendingHashes(db *sql.DB, stage hashStage, computerName, diskLabel, root string, relative, all bool, afterID int64, limit int) ([]pendingHash, error) {
+	prefix := root
+	if relative {
+		prefix = ""
+	}
+	rows, err := db.Query(pendingHashQueries[stage], computerName, diskLabel, len(prefix), prefix, afterID, all, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batch []pendingHash
+	for rows.Next() {
+		var p pendingHash
+		if err := rows.Scan(&p.id, &p.path, &p.size); err != nil {
+			return nil, err
+		}
+		batch = append(batch, p)
+	}
+	return batch, rows.Err()
+}
+
+// hashResult is a finished hash on its way to the database writer.
+type hashResult struct {
+	pendingHash
+	fullPath string
+	sample   bool
+	sum      string
+	created  int64
+	err      error
+}
+
+// defaultHashWorkers picks how many files to hash at once on drive: one on a
+// spinning disk, where parallel reads only add seeks, up to eight on SSDs, and
+// two when the drive type is unknown (network shares, other platforms).
+func defaultHashWorkers(volumes driveEnumerator, drive string) int {
+	rotational, err := volumes.Rotational(drive)
+	switch {
+	case err != nil:
+		return 2
+	case rotational:
+		return 1
+	}
+	return min(runtime.NumCPU(), 8)
+}
+
+// hashDrive fills in hashes for one drive in two passes, the same ones
+// dedupe.Run makes: a quick hash of the first dedupe.QuickHashSize bytes for
+// files whose size collides with another file, then a full hash only for
+// files whose quick hash collides too. Unlike Run it keeps every hash in the
+// database, so later runs and other drives build on them. Relative rows
+// (from -portable) are resolved against root. Hashes from another algorithm are
+// discarded first. Files that can't be read are counted as errors and left
+// unhashed so a later run retries them. The returned count covers both passes.
+// With all set, every file gets both passes, so exports carry a hash for each.
+// quickDone is called once the quick pass is written, and must return only
+// when every other drive's quick pass is too, since the full pass matches
+// against their quick hashes. Files strategies assigns hashSample get their
+// sampled hash in the quick pass, unless they are no larger than the samples
+// together and so are hashed like any other file, and files it assigns
+// hashSkip are passed over.
+func hashDrive(ctx context.Context, db *sql.DB, progress *driveProgress, computerName, diskLabel, root string, relative, all bool, zones []string, algo string, strategies hashStrategies, workers int, quickDone func()) (int, error) {
+	if err := markPrivacyZones(db, computerName, diskLabel, root, relative, zones); err != nil {
+		return 0, err
+	}
+	prefix := root
+	if relative {
+		prefix = ""
+	}
+	if _, err := db.Exec(`UPDATE files SET hash = NULL, quick_hash = NULL, hash_algo = NULL
+		WHERE computer = ? AND disk_label = ? AND substr(path, 1, ?) = ?
+		AND hash_algo IS NOT NULL AND hash_algo != ?`, computerName, diskLabel, len(prefix), prefix, algo); err != nil {
+		return 0, err
+	}
+
+	// Small files are fully covered by the quick hash, and sampled files
+	// get nothing more, so that pass stores both columns for them.
+	quick, err := db.Prepare(`UPDATE files SET quick_hash = ?1, hash_algo = ?2,
+		hash = CASE WHEN size <= ?3 OR ?1 LIKE '` + samplePrefix + `%' THEN ?1 ELSE hash END, created = COALESCE(?5, created) WHERE id = ?4`)
+	if err != nil {
+		return 0, err
+	}
+	defer quick.Close()
+	full, err := db.Prepare("UPDATE files SET hash = ?1, hash_algo = ?2, created = COALESCE(?5, created) WHERE id = ?4")
+	if err != nil {
+		return 0, err
+	}
+	defer full.Close()
+
+	count := 0
+	// The full pass selects on the quick hashes, so each pass is written out
+	// completely before the next one starts.
+	for stage, update := range []*sql.Stmt{stageQuick: quick, stageFull: full} {
+		n, err := hashPass(ctx, db, progress, hashStage(stage), update, computerName, diskLabel, root, relative, all, algo, strategies, max(workers, 1))
+		count += n
+		if err != nil {
+			return count, err
+		}
+		if hashStage(stage) == stageQuick {
+			quickDone()
+		}
+	}
+	return count, nil
+}
+
+// hashPass runs one stage: this goroutine queues pending rows batch by batch,
+// workers goroutines hash them, and a single writer stores the results, one
+// transaction per hashBatchSize files.
+func hashPass(ctx context.Context, db *sql.DB, progress *driveProgress, stage hashStage, update *sql.Stmt, computerName, diskLabel, root string, relative, all bool, algo string, strategies hashStrategies, workers int) (int, error) {
+	var limit int64
+	if stage == stageQuick {
+		limit = dedupe.QuickHashSize
+	}
+	jobs := make(chan hashResult, workers*2)
+	results := make(chan hashResult, workers*2)
+	var hashers sync.WaitGroup
+	for range workers {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				endHash := phases.track(phaseHash)
+				if job.sample {
+					job.sum, job.created, job.err = sampleHashFile(job.fullPath, algo, &progress.bytesRead)
+				} else {
+					job.sum, job.created, job.err = hashFile(job.fullPath, algo, limit, &progress.bytesRead)
+				}
+				endHash()
+				results <- job
+			}
+		}()
+	}
+	go func() {
+		hashers.Wait()
+		close(results)
+	}()
+
+	count := 0
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		batch := make([]hashResult, 0, hashBatchSize)
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			defer func() { batch = batch[:0] }()
+			endInsert := phases.track(phaseInsert)
+			defer endInsert()
+			tx, err := db.Begin()
+			if err != nil {
+				stats.addError("insert", err)
+				progress.logf("[ERROR] Failed to store %d hashes: %v\n", len(batch), err)
+				return
+			}
+			txUpdate := tx.Stmt(update)
+			stored := 0
+			for _, r := range batch {
+				var created any
+				if r.created != 0 {
+					created = r.created
+				}
+				if _, err := txUpdate.Exec(r.sum, algo, dedupe.QuickHashSize, r.id, created); err != nil {
+					stats.addError("insert", err)
+					progress.logf("[ERROR] Failed to store hash for %s: %v\n", r.fullPath, err)
+					continue
+				}
+				stored++
+			}
+			if err := tx.Commit(); err != nil {
+				stats.addError("insert", err)
+				progress.logf("[ERROR] Failed to store %d hashes: %v\n", len(batch), err)
+				return
+			}
+			count += stored
+			progress.hashed.Add(int64(stored))
+		}
+		for r := range results {
+			if r.err != nil {
+				stats.addError("hash", r.err)
+				continue
+			}
+			if batch = append(batch, r); len(batch) == hashBatchSize {
+				flush()
+			}
+		}
+		flush()
+	}()
+
+	var queryErr error
+	var lastID int64
+	for ctx.Err() == nil {
+		pending, err := nextPendingHashes(db, stage, computerName, diskLabel, root, relative, all, lastID, hashBatchSize)
+		if err != nil {
+			queryErr = err
+			break
+		}
+		if len(pending) == 0 {
+			break
+		}
+		for _, p := range pending {
+			lastID = p.id
+			path := p.path
+			if relative {
+				path = filepath.Join(root, p.path)
+			}
+			strategy := strategies.of(path)
+			if strategy == hashSkip {
+				continue
+			}
+			jobs <- hashResult{pendingHash: p, fullPath: path, sample: strategy == hashSample && p.size > sampleSize}
+		}
+	}
+	close(jobs)
+	<-writerDone
+	if queryErr != nil {
+		return count, queryErr
+	}
+	return count, ctx.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"Duplicate-File-Finder.main/dedupe"
+)
+
+// Hashing strategies the config can assign to file extensions. full is the
+// default quick-then-full hash. sample hashes the size and sampleChunks
+// chunks spread evenly through the file instead of every byte, for files
+// such as VM disk images that are too large to read in full on every scan.
+// skip never opens the file; it is matched by size and name only, like a file
+// scanned with -hash=false.
+const (
+	hashFull   = "full"
+	hashSample = "sample"
+	hashSkip   = "skip"
+)
+
+// samplePrefix marks a sampled hash in the hash column, so it never equals
+// the full hash of another file, and dedupe can leave sampled sets alone.
+const samplePrefix = "sample:"
+
+const (
+	sampleChunks    = 16
+	sampleChunkSize = 1 << 20
+	// sampleSize is what the samples read together. Files no larger than this
+	// gain nothing from sampling, so they get a full hash instead.
+	sampleSize = sampleChunks * sampleChunkSize
+)
+
+// hashStrategies maps lowercase extensions, with their dot, to the strategy
+// for files that have them. Extensions not listed get hashFull.
+type hashStrategies map[string]string
+
+// newHashStrategies checks the config's hashing section, such as
+// {".vmdk": "sample", "tmp": "skip"}.
+func newHashStrategies(entries map[string]string) (hashStrategies, error) {
+	s := hashStrategies{}
+	for ext, strategy := range entries {
+		switch strategy {
+		case hashFull, hashSample, hashSkip:
+		case "perceptual":
+			return nil, fmt.Errorf("hashing strategy for %s: perceptual matching is not supported (want %s, %s or %s)", ext, hashFull, hashSample, hashSkip)
+		default:
+			return nil, fmt.Errorf("unknown hashing strategy %q for %s (want %s, %s or %s)", strategy, ext, hashFull, hashSample, hashSkip)
+		}
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		s[ext] = strategy
+	}
+	return s, nil
+}
+
+// of returns the strategy for path.
+func (s hashStrategies) of(path string) string {
+	if strategy, ok := s[strings.ToLower(filepath.Ext(path))]; ok {
+		return strategy
+	}
+	return hashFull
+}
+
+// sampleHashFile returns the sampled hash of the file at path, with
+// samplePrefix, and its creation time. The file must be larger than
+// sampleSize.
+func sampleHashFile(path, algo string, bytesRead *atomic.Int64) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	created := fileCreated(f)
+	h, err := dedupe.NewHash(algo)
+	if err != nil {
+		return "", 0, err
+	}
+	if info.Size() <= sampleSize {
+		return "", 0, errors.New("shrank since it was scanned; rescan first")
+	}
+	binary.Write(h, binary.LittleEndian, info.Size())
+	buf := make([]byte, sampleChunkSize)
+	step := (info.Size() - sampleChunkSize) / (sampleChunks - 1)
+	for i := range int64(sampleChunks) {
+		n, err := f.ReadAt(buf, i*step)
+		if err != nil && err != io.EOF {
+			return "", 0, err
+		}
+		bytesRead.Add(int64(n))
+		h.Write(buf[:n])
+	}
+	return samplePrefix + hex.EncodeToString(h.Sum(nil)), created, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// startHealthServer serves GET /healthz for container orchestrators. It
+// always answers 200 while the process is alive and reports scan progress.
+func startHealthServer(addr string, display *progressDisplay) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		files, finished := display.totals()
+		status := "scanning"
+		if finished {
+			status = "finished"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"status": status, "files": files})
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Printf("[ERROR] Health server stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
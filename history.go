@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/text/message"
+)
+
+// actionsSchema is the log of every file dedupe deleted, sent to the Recycle
+// Bin, quarantined or replaced with a hard link. Rows are only ever added.
+const actionsSchema = `
+CREATE TABLE IF NOT EXISTS actions (
+	id INTEGER PRIMARY KEY,
+	at TEXT NOT NULL,
+	computer TEXT NOT NULL,
+	disk_label TEXT NOT NULL,
+	action TEXT NOT NULL,
+	path TEXT NOT NULL,
+	target TEXT NOT NULL,
+	hash_algo TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	bytes INTEGER NOT NULL,
+	rule TEXT NOT NULL
+);`
+
+// cleanupAction is one row of the actions log. target is where the file
+// went: the Recycle Bin, its place in quarantine, or the kept copy it is now
+// a hard link to; it is empty for a permanent delete. rule says what chose
+// the file, such as "newest" or "triage".
+type cleanupAction struct {
+	computer, diskLabel, action, path, target string
+	hashAlgo, hash                            string
+	bytes                                     int64
+	rule                                      string
+}
+
+// removedVerbs describes what happened to a removed copy, by action.
+var removedVerbs = map[string]string{
+	planDelete:     "deleted",
+	planRecycle:    "sent to the Recycle Bin",
+	planQuarantine: "quarantined",
+}
+
+func recordAction(db *sql.DB, a cleanupAction) error {
+	_, err := db.Exec(`INSERT INTO actions(at, computer, disk_label, action, path, target, hash_algo, hash, bytes, rule)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, time.Now().UTC().Format(time.RFC3339), a.computer, a.diskLabel, a.action,
+		a.path, a.target, a.hashAlgo, a.hash, a.bytes, a.rule)
+	if err != nil {
+		return fmt.Errorf("failed to log %s of %s: %v", a.action, a.path, err)
+	}
+	return nil
+}
+
+// printHistory lists the most recent limit actions, newest first, with the
+// total bytes they account for.
+func printHistory(db *sql.DB, w io.Writer, limit int) error {
+	rows, err := db.Query(`SELECT at, computer, action, path, target, hash, bytes, rule FROM actions
+		ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return fmt.Errorf("failed to query actions: %v", err)
+	}
+	defer rows.Close()
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	count, total := 0, int64(0)
+	for rows.Next() {
+		var at, computer, action, path, target, hash, rule string
+		var bytes int64
+		if err := rows.Scan(&at, &computer, &action, &path, &target, &hash, &bytes, &rule); err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
+		}
+		if count == 0 {
+			p.Fprintf(w, "%-20s %-20s %-10s %14s  %s\n", "AT", "COMPUTER", "ACTION", "BYTES", "PATH")
+		}
+		p.Fprintf(w, "%-20s %-20s %-10s %14d  %s\n", at, computer, action, bytes, path)
+		if target != "" {
+			fmt.Fprintf(w, "%68s-> %s\n", "", target)
+		}
+		if len(hash) > 16 {
+			fmt.Fprintf(w, "%68sby %s, hash %s\n", "", rule, hash[:16])
+		} else {
+			fmt.Fprintf(w, "%68sby %s\n", "", rule)
+		}
+		count++
+		total += bytes
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("row iteration error: %v", err)
+	}
+	if count == 0 {
+		fmt.Fprintln(w, "No cleanups have been recorded.")
+		return nil
+	}
+	p.Fprintf(w, "\n%d actions shown, %d bytes.\n", count, total)
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/message"
+)
+
+// exportedFile is one line of a JSON Lines export of the files table.
+type exportedFile struct {
+	Computer  string `json:"computer"`
+	DiskLabel string `json:"disk_label"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Mtime     int64  `json:"mtime,omitempty"`
+	HashAlgo  string `json:"hash_algo,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+// exportFiles writes every non-empty file in the index to w as JSON Lines, so
+// another machine's results can be compared without merging databases.
+func exportFiles(db *sql.DB, w io.Writer, anon *anonymizer) (int, error) {
+	rows, err := db.Query(`SELECT COALESCE(computer, ''), COALESCE(disk_label, ''), path, size,
+		COALESCE(mtime, 0), COALESCE(hash_algo, ''), COALESCE(hash, '')
+		FROM files WHERE size > 0 AND removed_at IS NULL ORDER BY computer, disk_label, path`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query files: %v", err)
+	}
+	defer rows.Close()
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	count := 0
+	for rows.Next() {
+		var f exportedFile
+		if err := rows.Scan(&f.Computer, &f.DiskLabel, &f.Path, &f.Size, &f.Mtime, &f.HashAlgo, &f.Hash); err != nil {
+			return count, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if f.Hash == "" {
+			f.HashAlgo = ""
+		}
+		f.Computer, f.DiskLabel, f.Path = anon.computer(f.Computer), anon.path(f.DiskLabel), anon.path(f.Path)
+		if err := enc.Encode(f); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	return count, out.Flush()
+}
+
+func loadExport(path string) ([]exportedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open export: %v", err)
+	}
+	defer f.Close()
+	var files []exportedFile
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var e exportedFile
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		files = append(files, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read export: %v", err)
+	}
+	return files, nil
+}
+
+// hostSide indexes one export by content and by size.
+type hostSide struct {
+	name string
+	// hashed holds the content keys present; uncertain the sizes with at least
+	// one file that has no hash, so a missing key there proves nothing.
+	hashed    map[string]bool
+	sizes     map[int64]bool
+	uncertain map[int64]bool
+	algos     map[int64]map[string]bool
+}
+
+// contentKey identifies f's content, or is empty when f has no hash to match
+// on. A sampled hash doesn't count, since not every byte was compared.
+func contentKey(f exportedFile) string {
+	if f.Hash == "" || strings.HasPrefix(f.Hash, samplePrefix) {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s:%d", f.HashAlgo, f.Hash, f.Size)
+}
+
+func newHostSide(name string, files []exportedFile) hostSide {
+	s := hostSide{name: name, hashed: map[string]bool{}, sizes: map[int64]bool{}, uncertain: map[int64]bool{}, algos: map[int64]map[string]bool{}}
+	for _, f := range files {
+		s.sizes[f.Size] = true
+		if key := contentKey(f); key != "" {
+			s.hashed[key] = true
+			if s.algos[f.Size] == nil {
+				s.algos[f.Size] = map[string]bool{}
+			}
+			s.algos[f.Size][f.HashAlgo] = true
+		} else {
+			s.uncertain[f.Size] = true
+		}
+	}
+	return s
+}
+
+// place returns whether other holds f's content: "both", "only", or
+// "unverified" when a same-size file there can't be ruled out.
+func (other hostSide) place(f exportedFile) string {
+	key := contentKey(f)
+	switch {
+	case !other.sizes[f.Size]:
+		return "only"
+	case key != "" && other.hashed[key]:
+		return "both"
+	case key == "" || other.uncertain[f.Size]:
+		return "unverified"
+	}
+	// Every same-size file there is hashed and none matches, but a hash from
+	// another algorithm proves nothing either.
+	for algo := range other.algos[f.Size] {
+		if algo != f.HashAlgo {
+			return "unverified"
+		}
+	}
+	return "only"
+}
+
+// compareHosts reports which content is only in the left export, only in the
+// right one, or in both. Content is matched by hash and size; files another
+// scan never hashed are checked by size alone and reported as unverified when
+// that isn't enough.
+func compareHosts(w io.Writer, leftPath, rightPath string) error {
+	left, err := loadExport(leftPath)
+	if err != nil {
+		return err
+	}
+	right, err := loadExport(rightPath)
+	if err != nil {
+		return err
+	}
+	name := func(path string) string {
+		return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	leftSide, rightSide := newHostSide(name(leftPath), left), newHostSide(name(rightPath), right)
+
+	type group struct {
+		files []string
+		bytes int64
+		sets  map[string]bool
+	}
+	groups := map[string]*group{}
+	add := func(heading string, f exportedFile) {
+		g := groups[heading]
+		if g == nil {
+			g = &group{sets: map[string]bool{}}
+			groups[heading] = g
+		}
+		g.files = append(g.files, fmt.Sprintf("[%s] [%s] %s", f.Computer, f.DiskLabel, f.Path))
+		key := contentKey(f)
+		if key == "" {
+			key = fmt.Sprintf("%s\x00%s\x00%s", f.Computer, f.DiskLabel, f.Path)
+		}
+		if !g.sets[key] {
+			g.sets[key] = true
+			g.bytes += f.Size
+		}
+	}
+	for _, f := range left {
+		switch rightSide.place(f) {
+		case "only":
+			add("Only on "+leftSide.name, f)
+		case "both":
+			add("On both", f)
+		default:
+			add("Unverified on "+leftSide.name+" (same size on "+rightSide.name+", not hashed)", f)
+		}
+	}
+	for _, f := range right {
+		switch leftSide.place(f) {
+		case "only":
+			add("Only on "+rightSide.name, f)
+		case "both":
+			add("On both", f)
+		default:
+			add("Unverified on "+rightSide.name+" (same size on "+leftSide.name+", not hashed)", f)
+		}
+	}
+
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	headings := make([]string, 0, len(groups))
+	for h := range groups {
+		headings = append(headings, h)
+	}
+	sort.Strings(headings)
+	for _, h := range headings {
+		g := groups[h]
+		sort.Strings(g.files)
+		fmt.Fprintf(w, "\n%s:\n", h)
+		for _, f := range g.files {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+	}
+	fmt.Fprintln(w)
+	unverified := false
+	for _, h := range headings {
+		g := groups[h]
+		p.Fprintf(w, "%s: %d files, %d distinct contents, %d bytes.\n", h, len(g.files), len(g.sets), g.bytes)
+		unverified = unverified || strings.HasPrefix(h, "Unverified")
+	}
+	if unverified {
+		fmt.Fprintln(w, "Hash both machines with -hash-all before exporting to settle the unverified files.")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/message"
+)
+
+// installerExtensions are the file types treated as installers or versioned downloads.
+var installerExtensions = map[string]bool{
+	".exe": true, ".msi": true, ".msix": true, ".appx": true, ".msixbundle": true,
+	".dmg": true, ".pkg": true, ".deb": true, ".rpm": true,
+}
+
+// versionInfo is the subset of a PE file's version resource used for grouping.
+type versionInfo struct {
+	ProductName string
+	CompanyName string
+	Version     string
+}
+
+type installerFile struct {
+	path    string
+	size    int64
+	product string
+	company string
+	version []int
+}
+
+var (
+	versionPattern    = regexp.MustCompile(`\d+(?:[._]\d+)+|\d+`)
+	copySuffixPattern = regexp.MustCompile(`\s*\(\d+\)$`)
+	nameNoisePattern  = regexp.MustCompile(`(?i)[-_. ]*(?:v(?:er(?:sion)?)?)?[-_. ]*\d+(?:[._]\d+)*|[-_. ](?:x64|x86|amd64|arm64|win32|win64|setup|installer|full)\b`)
+	separatorsPattern = regexp.MustCompile(`[-_. ]+`)
+)
+
+// parseVersion extracts the first dotted number sequence, e.g. "setup-1.2.10" -> [1 2 10].
+func parseVersion(s string) []int {
+	m := versionPattern.FindString(s)
+	if m == "" {
+		return nil
+	}
+	var parts []int
+	for _, p := range strings.FieldsFunc(m, func(r rune) bool { return r == '.' || r == '_' }) {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func formatVersion(v []int) string {
+	if len(v) == 0 {
+		return "?"
+	}
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// productFromName strips version numbers, architecture tags and browser
+// "(1)" copy suffixes so setup-1.2.exe and setup-1.3 (1).exe group together.
+func productFromName(name string) string {
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	stem = copySuffixPattern.ReplaceAllString(stem, "")
+	stem = nameNoisePattern.ReplaceAllString(stem, " ")
+	stem = separatorsPattern.ReplaceAllString(stem, " ")
+	return strings.ToLower(strings.TrimSpace(stem))
+}
+
+// findInstallerGroups lists installers directly inside dir and groups them by
+// product, using PE version info when available and the file name otherwise.
+// Only products with more than one file are returned, newest version first.
+func findInstallerGroups(dir string) ([][]installerFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string][]installerFile{}
+	for _, e := range entries {
+		if e.IsDir() || !installerExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		f := installerFile{
+			path:    filepath.Join(dir, e.Name()),
+			size:    info.Size(),
+			product: productFromName(e.Name()),
+			version: parseVersion(e.Name()),
+		}
+		if vi, ok := readVersionInfo(f.path); ok && vi.ProductName != "" {
+			f.product = strings.ToLower(strings.TrimSpace(vi.ProductName))
+			f.company = vi.CompanyName
+			if v := parseVersion(vi.Version); len(v) > 0 {
+				f.version = v
+			}
+		}
+		if f.product == "" {
+			continue
+		}
+		key := f.product + "\x00" + strings.ToLower(f.company)
+		groups[key] = append(groups[key], f)
+	}
+
+	var result [][]installerFile
+	for _, g := range groups {
+		if len(g) < 2 {
+			continue
+		}
+		sort.SliceStable(g, func(i, j int) bool { return compareVersions(g[i].version, g[j].version) > 0 })
+		result = append(result, g)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i][0].product < result[j][0].product })
+	return result, nil
+}
+
+// printInstallerReport suggests keeping only the newest version of each product.
+func printInstallerReport(w io.Writer, dir string, groups [][]installerFile) {
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	if len(groups) == 0 {
+		fmt.Fprintf(w, "No repeated installers found in %s\n", dir)
+		return
+	}
+	var reclaimable int64
+	for _, g := range groups {
+		title := g[0].product
+		if g[0].company != "" {
+			title += " (" + g[0].company + ")"
+		}
+		fmt.Fprintf(w, "\n%s\n", title)
+		for i, f := range g {
+			action := "remove"
+			if i == 0 {
+				action = "keep"
+			} else {
+				reclaimable += f.size
+			}
+			p.Fprintf(w, "  %-6s %-12s %14d bytes  %s\n", action, formatVersion(f.version), f.size, f.path)
+		}
+	}
+	p.Fprintf(w, "\n%d products with older versions; keeping only the newest would free %d bytes.\n", len(groups), reclaimable)
+}
+
+// defaultDownloadsDir returns the current user's Downloads folder.
+func defaultDownloadsDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, "Downloads")
+}
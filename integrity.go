@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/message"
+	"modernc.org/sqlite"
+)
+
+// Row checksums are optional: db enable-checksums fills in the row_sum column
+// of files and turns on the row_sums setting, and from then on every
+// connection dff opens keeps the column up to date with TEMP triggers. Those
+// triggers exist only inside dff, so a row changed by any other program, or
+// damaged by a crash or a bad disk, no longer matches its checksum and db
+// verify-integrity reports it.
+
+// rowSumColumns are the columns a row checksum covers: everything that
+// decides which files are reported as duplicates of each other.
+var rowSumColumns = []string{"computer", "disk_label", "path", "size", "mtime", "hash", "hash_algo", "private"}
+
+// rowSumOf is the SQL expression for the checksum of the row the columns
+// are read from, prefixed with prefix such as "NEW.".
+func rowSumOf(prefix string) string {
+	return "dff_row_sum(" + prefix + strings.Join(rowSumColumns, ", "+prefix) + ")"
+}
+
+var registerRowSums = sync.OnceFunc(func() {
+	sqlite.MustRegisterDeterministicScalarFunction("dff_row_sum", -1, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return rowSum(args), nil
+	})
+	sqlite.RegisterConnectionHook(func(conn sqlite.ExecQuerierContext, _ string) error {
+		enabled, err := rowSumsEnabled(conn)
+		if err != nil || !enabled {
+			return err
+		}
+		return createRowSumTriggers(conn)
+	})
+})
+
+// rowSum hashes the values of a row, keeping NULL apart from an empty string
+// and each value apart from its neighbours.
+func rowSum(values []driver.Value) string {
+	h := sha256.New()
+	for _, v := range values {
+		if v == nil {
+			h.Write([]byte{0})
+			continue
+		}
+		s := fmt.Sprint(v)
+		if b, ok := v.([]byte); ok {
+			s = string(b)
+		}
+		h.Write([]byte{1})
+		binary.Write(h, binary.LittleEndian, uint64(len(s)))
+		io.WriteString(h, s)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// rowSumsSetting names the row in settings that is present while row
+// checksums are enabled.
+const rowSumsSetting = "row_sums"
+
+// rowSumsEnabled reports whether the row_sums setting is on. The connection
+// hook runs before migrations, so the settings table may not exist yet.
+func rowSumsEnabled(conn sqlite.ExecQuerierContext) (bool, error) {
+	count := func(query string, args ...driver.NamedValue) (int64, error) {
+		rows, err := conn.QueryContext(context.Background(), query, args)
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		dest := make([]driver.Value, 1)
+		if err := rows.Next(dest); err != nil {
+			return 0, err
+		}
+		n, _ := dest[0].(int64)
+		return n, nil
+	}
+	tables, err := count("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'settings'")
+	if err != nil || tables == 0 {
+		return false, err
+	}
+	n, err := count("SELECT COUNT(*) FROM settings WHERE name = ?", driver.NamedValue{Ordinal: 1, Value: rowSumsSetting})
+	return n > 0, err
+}
+
+func createRowSumTriggers(conn sqlite.ExecQuerierContext) error {
+	sum := rowSumOf("NEW.")
+	_, err := conn.ExecContext(context.Background(), `
+		CREATE TEMP TRIGGER IF NOT EXISTS files_row_sum_insert AFTER INSERT ON main.files
+		BEGIN UPDATE files SET row_sum = `+sum+` WHERE id = NEW.id; END;
+		CREATE TEMP TRIGGER IF NOT EXISTS files_row_sum_update AFTER UPDATE OF `+strings.Join(rowSumColumns, ", ")+` ON main.files
+		BEGIN UPDATE files SET row_sum = `+sum+` WHERE id = NEW.id; END;`, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create row checksum triggers: %v", err)
+	}
+	return nil
+}
+
+// enableRowSums turns on the row_sums setting, fills in the row_sum column
+// for every row, and starts maintaining it on this connection; later
+// connections pick it up in the hook.
+func enableRowSums(db *sql.DB) error {
+	if _, err := db.Exec("INSERT OR IGNORE INTO settings(name, value) VALUES(?, 'on')", rowSumsSetting); err != nil {
+		return fmt.Errorf("failed to enable row checksums: %v", err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Raw(func(c any) error {
+		return createRowSumTriggers(c.(sqlite.ExecQuerierContext))
+	})
+	if err != nil {
+		return err
+	}
+	result, err := conn.ExecContext(context.Background(), "UPDATE files SET row_sum = "+rowSumOf(""))
+	if err != nil {
+		return fmt.Errorf("failed to compute row checksums: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	message.NewPrinter(message.MatchLanguage("en")).Printf("Row checksums enabled for %d files.\n", n)
+	return nil
+}
+
+// verifyIntegrity runs SQLite's own integrity check and, when row checksums
+// are enabled, lists the rows whose content no longer matches its checksum.
+// With repair those rows are deleted, so the next scan records their files
+// afresh; a rescan alone would keep a tampered hash for an unchanged file. It
+// returns the number of problems found.
+func verifyIntegrity(db *sql.DB, w io.Writer, repair bool) (int, error) {
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	problems := 0
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return 0, fmt.Errorf("failed to check the database: %v", err)
+	}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if line != "ok" {
+			fmt.Fprintf(w, "SQLite: %s\n", line)
+			problems++
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if problems == 0 {
+		fmt.Fprintln(w, "SQLite integrity check: ok")
+	}
+
+	var enabled int
+	if err := db.QueryRow("SELECT COUNT(*) FROM settings WHERE name = ?", rowSumsSetting).Scan(&enabled); err != nil {
+		return problems, fmt.Errorf("failed to check for row checksums: %v", err)
+	}
+	if enabled == 0 {
+		fmt.Fprintln(w, "Row checksums are not enabled; run dff db enable-checksums to detect rows changed outside dff.")
+		return problems, nil
+	}
+	rows, err = db.Query(`SELECT id, COALESCE(computer, ''), COALESCE(disk_label, ''), path FROM files
+		WHERE row_sum IS NOT ` + rowSumOf("") + ` ORDER BY id`)
+	if err != nil {
+		return problems, fmt.Errorf("failed to verify row checksums: %v", err)
+	}
+	defer rows.Close()
+	mismatched := 0
+	for rows.Next() {
+		var id int64
+		var computer, diskLabel, path string
+		if err := rows.Scan(&id, &computer, &diskLabel, &path); err != nil {
+			return problems, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if mismatched < 50 {
+			fmt.Fprintf(w, "Row %d does not match its checksum: [%s] [%s] %s\n", id, computer, diskLabel, path)
+		}
+		mismatched++
+	}
+	if err := rows.Err(); err != nil {
+		return problems, err
+	}
+	rows.Close()
+	switch {
+	case mismatched > 0 && repair:
+		if _, err := db.Exec("DELETE FROM files WHERE row_sum IS NOT " + rowSumOf("")); err != nil {
+			return problems, fmt.Errorf("failed to delete mismatched rows: %v", err)
+		}
+		p.Fprintf(w, "Deleted %d rows that were changed outside dff or damaged; scan their drives to record them again.\n", mismatched)
+	case mismatched > 0:
+		p.Fprintf(w, "%d rows were changed outside dff or damaged; run verify-integrity -write to delete them, then scan their drives again.\n", mismatched)
+	default:
+		fmt.Fprintln(w, "Row checksums: ok")
+	}
+	return problems + mismatched, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// unsafeNameChars can't appear in a file name on Windows.
+var unsafeNameChars = strings.NewReplacer(`<`, "_", `>`, "_", `:`, "_", `"`, "_", `/`, "_", `\`, "_", `|`, "_", `?`, "_", `*`, "_")
+
+// writeLinkFarm fills dir with one folder per duplicate set on this computer,
+// the top sets by wasted space, each holding a link to every copy so the sets
+// can be browsed and previewed in Explorer. Symbolic links are used where
+// they can be created; elsewhere, such as on Windows without developer mode,
+// each copy gets a .url shortcut instead. Sets matched only on a sampled hash
+// are left out. dir must be new or empty. It returns the number of sets and
+// links written.
+func writeLinkFarm(db *sql.DB, dir, computerName, algo string, top int) (int, int, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return 0, 0, fmt.Errorf("%s is not empty", dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, 0, err
+	}
+	rows, err := db.Query(`SELECT hash, size FROM files
+		WHERE computer = ?1 AND hash_algo = ?2 AND hash IS NOT NULL AND size > 0 AND removed_at IS NULL
+		AND hash NOT LIKE '`+samplePrefix+`%'
+		GROUP BY hash, size HAVING COUNT(*) > 1
+		ORDER BY size * (COUNT(*) - 1) DESC, hash LIMIT ?3`, computerName, algo, top)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query duplicate sets: %v", err)
+	}
+	var sets []duplicateSet
+	for rows.Next() {
+		var s duplicateSet
+		if err := rows.Scan(&s.key, &s.size); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan row: %v", err)
+		}
+		sets = append(sets, s)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	links := 0
+	for i, s := range sets {
+		var paths []string
+		rows, err := db.Query(`SELECT path FROM files WHERE computer = ? AND hash_algo = ? AND hash = ? AND size = ? AND removed_at IS NULL ORDER BY path`,
+			computerName, algo, s.key, s.size)
+		if err != nil {
+			return i, links, fmt.Errorf("failed to query duplicate set: %v", err)
+		}
+		for rows.Next() {
+			var p string
+			if err := rows.Scan(&p); err != nil {
+				rows.Close()
+				return i, links, fmt.Errorf("failed to scan row: %v", err)
+			}
+			paths = append(paths, p)
+		}
+		if err := rows.Close(); err != nil {
+			return i, links, err
+		}
+		setDir := filepath.Join(dir, fmt.Sprintf("%03d %s", i+1, unsafeNameChars.Replace(filepath.Base(paths[0]))))
+		if err := os.Mkdir(setDir, 0o755); err != nil {
+			return i, links, err
+		}
+		for j, p := range paths {
+			// Copies usually share a name, so each link is numbered.
+			name := filepath.Join(setDir, fmt.Sprintf("%d %s", j+1, unsafeNameChars.Replace(filepath.Base(p))))
+			if err := os.Symlink(p, name); err != nil {
+				if err := writeURLShortcut(name+".url", p); err != nil {
+					return i, links, err
+				}
+			}
+			links++
+		}
+	}
+	return len(sets), links, nil
+}
+
+// writeURLShortcut writes an Internet Shortcut to the file at target, which
+// Explorer opens like the file itself.
+func writeURLShortcut(name, target string) error {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(target)}
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+	return os.WriteFile(name, []byte("[InternetShortcut]\r\nURL="+u.String()+"\r\n"), 0o644)
+}
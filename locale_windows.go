@@ -0,0 +1,20 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const localeNameMaxLength = 85
+
+// systemLocale returns the user's locale, such as "sv-SE", as set under
+// Region in Settings, or "" when Windows doesn't say.
+func systemLocale() string {
+	getUserDefaultLocaleName := syscall.NewLazyDLL("kernel32.dll").NewProc("GetUserDefaultLocaleName")
+	buf := make([]uint16, localeNameMaxLength)
+	n, _, _ := getUserDefaultLocaleName.Call(uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	if n == 0 {
+		return ""
+	}
+	return syscall.UTF16ToString(buf)
+}
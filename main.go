@@ -1,163 +1,281 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-	"unsafe"
 
-	"github.com/StackExchange/wmi"
+	"Duplicate-File-Finder.main/dedupe"
 	"golang.org/x/text/message"
 	_ "modernc.org/sqlite"
 )
 
-func listDrives() []string {
-	if runtime.GOOS != "windows" {
-		fmt.Println("This program is designed to run on Windows.")
-		return nil
+// sqliteDSN adds the pragmas every connection runs on open. By default the
+// database uses WAL, so reports can read it while a scan is writing, with
+// NORMAL syncs and a 64 MB page cache for fast inserts. safe keeps SQLite's
+// rollback journal and full syncs instead, for filesystems such as network
+// shares where WAL is not reliable.
+func sqliteDSN(dbPath string, safe bool) string {
+	if safe {
+		return dbPath + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(DELETE)&_pragma=synchronous(FULL)"
 	}
+	return dbPath + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=cache_size(-65536)"
+}
 
-	drives := []string{}
-	kernel32 := syscall.NewLazyDLL("kernel32.dll")
-	getLogicalDrives := kernel32.NewProc("GetLogicalDrives")
-
-	ret, _, _ := getLogicalDrives.Call()
-	for i := 0; i < 26; i++ {
-		if ret&(1<<uint(i)) != 0 {
-			drives = append(drives, fmt.Sprintf("%c:\\", 'A'+i))
-		}
+func setupDatabase(dbPath string, safe bool) (*sql.DB, error) {
+	registerRowSums()
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath, safe))
+	if err != nil {
+		return nil, err
 	}
-	return drives
+	// Drives are scanned concurrently; funnel every write through a single
+	// connection so SQLite never reports the database as locked.
+	db.SetMaxOpenConns(1)
+	if err := migrateSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
-func setupDatabase(dbPath string) (*sql.DB, error) {
-	fileExists := false
-	if _, err := os.Stat(dbPath); err == nil {
-		fileExists = true
-	}
-	db, err := sql.Open("sqlite", dbPath)
+// fileRecorder stores one walked file or directory.
+type fileRecorder func(e walkedEntry) error
+
+// defaultInsertBatchSize is how many walked files are committed per
+// transaction; committing every row on its own dominates the walk time.
+const defaultInsertBatchSize = 5000
+
+// unchangedFile is true when an upserted row still describes the same content:
+// same size and modification time. Rows recorded before mtimes were tracked
+// keep their hashes on the first rescan.
+const unchangedFile = "files.size = excluded.size AND (files.mtime IS NULL OR files.mtime = excluded.mtime)"
+
+// newFileRecorder upserts walked files into the files table for one drive,
+// batchSize rows per transaction. Rows are buffered in memory and written in
+// one go, so the shared connection is only held while a batch is flushed and
+// not while a slow disk is being enumerated. The returned function flushes the
+// last batch and releases the prepared statement; it must be called before the
+// rows are read back.
+func newFileRecorder(db *sql.DB, computerName, diskLabel string, scanID int64, batchSize int) (fileRecorder, func() error, error) {
+	stmt, err := db.Prepare(`INSERT INTO files(path, computer, disk_label, size, mtime, created, attributes, scan_id) VALUES(?, ?, ?, ?, ?, NULLIF(?, 0), ?, ?)
+	ON CONFLICT(path, computer, disk_label) DO UPDATE SET size=excluded.size, mtime=excluded.mtime,
+		attributes=excluded.attributes, scan_id=excluded.scan_id, created=COALESCE(files.created, excluded.created), removed_at=NULL,
+		hash=CASE WHEN ` + unchangedFile + ` THEN files.hash END,
+		hash_algo=CASE WHEN ` + unchangedFile + ` THEN files.hash_algo END,
+		quick_hash=CASE WHEN ` + unchangedFile + ` THEN files.quick_hash END`)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if !fileExists {
-		_, err = db.Exec(`CREATE TABLE files (
-			id INTEGER PRIMARY KEY,
-			path TEXT NOT NULL,
-			computer TEXT,
-			disk_label TEXT,
-			size INTEGER,
-			UNIQUE(path, computer, disk_label)
-		)`)
+	batchSize = max(batchSize, 1)
+	batch := make([]walkedEntry, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch = batch[:0] }()
+		tx, err := db.Begin()
 		if err != nil {
-			db.Close()
-			return nil, err
+			return fmt.Errorf("failed to begin transaction: %v", err)
 		}
-	} else {
-		_, err = db.Exec(`CREATE TABLE IF NOT EXISTS files (
-			id INTEGER PRIMARY KEY,
-			path TEXT NOT NULL,
-			computer TEXT,
-			disk_label TEXT,
-			size INTEGER,
-			UNIQUE(path, computer, disk_label)
-		)`)
+		txStmt := tx.Stmt(stmt)
+		var failed int
+		var firstErr error
+		for _, f := range batch {
+			if _, err := txStmt.Exec(f.path, computerName, diskLabel, f.size, f.mtime, f.created, f.attrs, scanID); err != nil {
+				if failed++; firstErr == nil {
+					firstErr = fmt.Errorf("%s: %v", f.path, err)
+				}
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit %d rows: %v", len(batch), err)
+		}
+		if firstErr != nil {
+			return fmt.Errorf("%d of %d rows in the batch failed, first %v", failed, len(batch), firstErr)
+		}
+		return nil
+	}
+	record := func(e walkedEntry) error {
+		batch = append(batch, e)
+		if len(batch) < batchSize {
+			return nil
+		}
+		return flush()
+	}
+	return record, sync.OnceValue(func() error {
+		err := flush()
+		stmt.Close()
+		return err
+	}), nil
+}
+
+// portableComputerPrefix marks rows recorded with -portable. Their computer
+// column holds the volume serial instead of a machine name and their paths are
+// relative to the volume root, so the rows stay valid on any machine and
+// under any drive letter.
+const portableComputerPrefix = "portable:"
+
+// relativeRecorder stores paths relative to root.
+func relativeRecorder(root string, record fileRecorder) fileRecorder {
+	return func(e walkedEntry) error {
+		rel, err := filepath.Rel(root, e.path)
 		if err != nil {
-			db.Close()
-			return nil, err
+			return err
 		}
+		e.path = rel
+		return record(e)
 	}
-	return db, nil
 }
 
-func walkFiles(root string, db *sql.DB, progress chan<- int, computerName, diskLabel string) (int, error) {
-	stmt, err := db.Prepare(`INSERT INTO files(path, computer, disk_label, size) VALUES(?, ?, ?, ?)
-	ON CONFLICT(path, computer, disk_label) DO UPDATE SET size=excluded.size`)
-	if err != nil {
-		return 0, err
+// walkFiles records every file and directory under root that skip lets
+// through. With more than one worker the tree is enumerated by walkParallel
+// instead.
+func walkFiles(ctx context.Context, root string, record fileRecorder, progress *driveProgress, skip walkFilter, workers int) (int, error) {
+	if workers > 1 {
+		return walkParallel(ctx, root, record, progress, skip, workers)
 	}
-	defer stmt.Close()
 	count := 0
-	err = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+	// Time between callbacks is time spent inside WalkDir enumerating directories.
+	// Everything from the previous callback's end to this one's end is charged
+	// to the entry's parent directory for the slowest-directories summary.
+	lastReturn := time.Now()
+	dirTimes := map[string]time.Duration{}
+	defer stats.mergeDirTimes(dirTimes)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		phases.add(phaseWalk, time.Since(lastReturn))
+		defer func() {
+			now := time.Now()
+			dirTimes[filepath.Dir(path)] += now.Sub(lastReturn)
+			lastReturn = now
+		}()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
+			progress.addError("walk", err)
+			return nil
+		}
+		if skip.skips(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// A symbolic link would be hashed as its target and reported as a
+		// copy of it, so links are left out and only targets are recorded.
+		if d.Type()&os.ModeSymlink != 0 && path != root {
 			return nil
 		}
-		var size int64 = 0
+		e := walkedEntry{path: path}
 		if !d.IsDir() {
+			endStat := phases.track(phaseStat)
 			info, statErr := d.Info()
+			endStat()
 			if statErr == nil {
-				size = info.Size()
+				e = statEntry(path, info)
+			} else {
+				progress.addError("stat", statErr)
+			}
+			if skip.skipsModified(e.mtime) {
+				return nil
 			}
 		}
-		_, err = stmt.Exec(path, computerName, diskLabel, size)
+		endInsert := phases.track(phaseInsert)
+		err = record(e)
+		endInsert()
 		if err == nil {
 			count++
 			if progress != nil {
-				progress <- count
+				progress.files.Store(int64(count))
 			}
 		} else {
-			fmt.Printf("[ERROR] Failed to insert or update %s: %v\n", path, err)
+			progress.addError("insert", err)
+			progress.logf("[ERROR] Failed to insert or update %s: %v\n", path, err)
 		}
 		return nil
 	})
-	if progress != nil {
-		progress <- count
-	}
 	return count, err
 }
 
-func getDiskUsage(path string) (total, free, used uint64, err error) {
-	var freeBytesAvailable, totalNumberOfBytes, totalNumberOfFreeBytes int64
-	dll := syscall.NewLazyDLL("kernel32.dll")
-	proc := dll.NewProc("GetDiskFreeSpaceExW")
-	pathPtr, err := syscall.UTF16PtrFromString(path)
-	if err != nil {
-		return
+// findDrive matches user input against the available drives: by letter for
+// Windows drives (C, c:, C:\) and by path for mount points.
+func findDrive(drives []string, input string) (string, bool) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", false
 	}
-	r1, _, e1 := proc.Call(
-		uintptr(unsafe.Pointer(pathPtr)),
-		uintptr(unsafe.Pointer(&freeBytesAvailable)),
-		uintptr(unsafe.Pointer(&totalNumberOfBytes)),
-		uintptr(unsafe.Pointer(&totalNumberOfFreeBytes)),
-	)
-	if r1 == 0 {
-		err = e1
-		return
+	for _, d := range drives {
+		if len(d) >= 2 && d[1] == ':' {
+			if strings.EqualFold(d[:1], input[:1]) {
+				return d, true
+			}
+		} else if filepath.Clean(d) == filepath.Clean(input) {
+			return d, true
+		}
 	}
-	total = uint64(totalNumberOfBytes)
-	free = uint64(totalNumberOfFreeBytes)
-	used = total - free
-	return
+	return "", false
 }
 
-func getDiskLabel(drive string) string {
-	var volumeName [256]uint16
-	var fsName [256]uint16
-	var serialNumber, maxComponentLen, fileSysFlags uint32
-	driveRoot := drive[0:3]
-	kernel32 := syscall.NewLazyDLL("kernel32.dll")
-	getVolumeInformationW := kernel32.NewProc("GetVolumeInformationW")
-	ptr, _ := syscall.UTF16PtrFromString(driveRoot)
-	ret, _, _ := getVolumeInformationW.Call(
-		uintptr(unsafe.Pointer(ptr)),
-		uintptr(unsafe.Pointer(&volumeName[0])),
-		uintptr(len(volumeName)),
-		uintptr(unsafe.Pointer(&serialNumber)),
-		uintptr(unsafe.Pointer(&maxComponentLen)),
-		uintptr(unsafe.Pointer(&fileSysFlags)),
-		uintptr(unsafe.Pointer(&fsName[0])),
-		uintptr(len(fsName)),
-	)
-	if ret != 0 {
-		return syscall.UTF16ToString(volumeName[:])
-	}
-	return ""
+// applyEnvOverrides sets every flag that was not given on the command line
+// from a DFF_<NAME> environment variable, e.g. DFF_DELETE_ALL for -delete-all,
+// so the tool can be configured entirely from a container's environment.
+func applyEnvOverrides(fs *flag.FlagSet) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		name := "DFF_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// notifyScanFinished raises a desktop notification summarizing the scan, with
+// a button to open the last exported report when there is one.
+func notifyScanFinished(scans []*driveProgress, totalFiles int64, interrupted bool) {
+	var failed []string
+	for _, dp := range scans {
+		if dp.failed.Load() {
+			failed = append(failed, dp.drive)
+		}
+	}
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	title := "Scan finished"
+	body := p.Sprintf("%d files indexed on %d drive(s).", totalFiles, len(scans))
+	switch {
+	case interrupted:
+		title = "Scan interrupted"
+	case len(failed) > 0:
+		title = "Scan finished with errors"
+		body += " Failed: " + strings.Join(failed, ", ")
+	}
+	report := "files.csv"
+	if _, err := os.Stat(report); err != nil {
+		report = ""
+	}
+	if err := sendNotification("Duplicate File Finder: "+title, body, report); err != nil {
+		fmt.Printf("[ERROR] Failed to show notification: %v\n", err)
+	}
 }
 
 func getComputerName() string {
@@ -168,31 +286,15 @@ func getComputerName() string {
 	return name
 }
 
-type Win32_PerfFormattedData_PerfOS_Processor struct {
-	Name                 string
-	PercentProcessorTime uint64
-}
-
-func getCPUUsageWMI() string {
-	var dst []Win32_PerfFormattedData_PerfOS_Processor
-	err := wmi.Query("SELECT Name, PercentProcessorTime FROM Win32_PerfFormattedData_PerfOS_Processor WHERE Name = '_Total'", &dst)
-	if err != nil {
-		return fmt.Sprintf("Error getting CPU usage via WMI: %v", err)
-	}
-	if len(dst) == 0 {
-		return "CPU Usage: N/A"
-	}
-	return fmt.Sprintf("CPU Usage: %d%%", dst[0].PercentProcessorTime)
-}
-
-func exportFilesTableToCSV(dbPath, csvPath string) error {
-	db, err := sql.Open("sqlite", dbPath)
+func exportFilesTableToCSV(dbPath string, safe bool, csvPath string, theme reportTheme, anon *anonymizer) error {
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath, safe))
 	if err != nil {
 		return fmt.Errorf("failed to open database: %v", err)
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT id, path, computer, disk_label, size FROM files")
+	// Column names come from the reportColumns allowlist, never from raw input.
+	rows, err := db.Query("SELECT " + strings.Join(theme.Columns, ", ") + " FROM files WHERE removed_at IS NULL")
 	if err != nil {
 		return fmt.Errorf("failed to query files table: %v", err)
 	}
@@ -207,25 +309,31 @@ func exportFilesTableToCSV(dbPath, csvPath string) error {
 	w := csv.NewWriter(file)
 	defer w.Flush()
 
-	// Write header
-	err = w.Write([]string{"id", "path", "computer", "disk_label", "size"})
-	if err != nil {
-		return fmt.Errorf("failed to write CSV header: %v", err)
+	if theme.header() {
+		if err := w.Write(theme.Columns); err != nil {
+			return fmt.Errorf("failed to write CSV header: %v", err)
+		}
 	}
 
+	values := make([]sql.NullString, len(theme.Columns))
+	dest := make([]any, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	record := make([]string, len(values))
 	for rows.Next() {
-		var id int
-		var path, computer, diskLabel string
-		var size int64
-		if err := rows.Scan(&id, &path, &computer, &diskLabel, &size); err != nil {
+		if err := rows.Scan(dest...); err != nil {
 			return fmt.Errorf("failed to scan row: %v", err)
 		}
-		record := []string{
-			fmt.Sprintf("%d", id),
-			path,
-			computer,
-			diskLabel,
-			fmt.Sprintf("%d", size),
+		for i, v := range values {
+			switch theme.Columns[i] {
+			case "path", "disk_label":
+				record[i] = anon.path(v.String)
+			case "computer":
+				record[i] = anon.computer(v.String)
+			default:
+				record[i] = v.String
+			}
 		}
 		if err := w.Write(record); err != nil {
 			return fmt.Errorf("failed to write CSV record: %v", err)
@@ -237,32 +345,617 @@ func exportFilesTableToCSV(dbPath, csvPath string) error {
 	return nil
 }
 
+// commands are the subcommands that run a single phase against the database.
+// With no subcommand the drives are walked, hashed and reported in one go.
+var commands = []struct{ name, summary string }{
+	{"scan", "walk the drives and record files, without hashing"},
+	{"hash", "hash files already recorded for the drives, without walking"},
+	{"report", "print the duplicate sets in the database"},
+	{"triage", "review duplicate sets one at a time and record which copy to keep"},
+	{"dedupe", "delete this computer's duplicates, keeping one copy per set by the -keep rule"},
+	{"review", "like dedupe, but choose the copy to keep in each set interactively first"},
+	{"apply-plan", "carry out a plan file written by -dry-run, after checking every file's hash still matches"},
+	{"restore", "move files quarantined by dedupe back to where they came from"},
+	{"history", "list the files dedupe and restore acted on, newest first, up to -top"},
+	{"coverage", "list files under the given masters directories with no copy on another volume"},
+	{"links", "write a folder of links to the copies in the top duplicate sets to -o, for browsing in Explorer"},
+	{"rescan", "walk and hash like a full run, keeping unchanged files' hashes and removing deleted files"},
+	{"export", "write the indexed files as JSON Lines to -o or stdout"},
+	{"compare-hosts", "compare two exports (-left, -right) by content"},
+	{"clean", "remove files that no longer exist on the drives from the database"},
+	{"db", "maintain the database (run \"dff db\" for details)"},
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "db" {
+		exit(runDBCommand(os.Args[2:]))
+	}
+	command, args := "", os.Args[1:]
+	if len(args) > 0 {
+		for _, c := range commands {
+			if args[0] == c.name {
+				command, args = c.name, args[1:]
+				break
+			}
+		}
+	}
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [command] [flags] [directory ...]\n\nCommands:\n", filepath.Base(os.Args[0]))
+		for _, c := range commands {
+			fmt.Fprintf(out, "  %-14s %s\n", c.name, c.summary)
+		}
+		fmt.Fprintf(out, "\nWith no command, drives are scanned, hashed and reported. Directories limit\nthe scan to those trees instead of every drive.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+
 	deleteFlag := flag.Bool("delete-all", false, "Delete all data in the database before scanning.")
-	driveFlag := flag.String("drive", "", "Scan only the specified drive letter (e.g. C, D, E).")
+	driveFlag := flag.String("drive", "", "Scan only the specified drive letter (e.g. C, D, E) or mount point.")
+	pathFlag := flag.String("path", "", "Scan only this directory. More directories can be given as arguments after the flags.")
+	var includeFlag, excludeFlag patternList
+	flag.Var(&includeFlag, "include", "Index only files whose name matches this glob, or whose path matches re:REGEX. Repeatable.")
+	flag.Var(&excludeFlag, "exclude", "Skip files and directories whose name matches this glob, or whose path matches re:REGEX. Repeatable.")
+	var modifiedAfterFlag, modifiedBeforeFlag dateFlag
+	flag.Var(&modifiedAfterFlag, "modified-after", "Index only files modified on or after this date (YYYY-MM-DD or RFC 3339).")
+	flag.Var(&modifiedBeforeFlag, "modified-before", "Index only files modified before this date (YYYY-MM-DD or RFC 3339).")
+	allDrivesFlag := flag.Bool("all-drives", false, "Scan every drive. This is the default when no -drive, -path or directory arguments are given.")
 	reportFlag := flag.Bool("report", false, "Export the files table to files.csv and exit.")
-	flag.Parse()
+	dbFlag := flag.String("db", "files.db", "Path of the SQLite database.")
+	safeDBFlag := flag.Bool("safe-db", false, "Open the database with SQLite's rollback journal and full syncs instead of WAL, e.g. when it lives on a network share.")
+	configFlag := flag.String("config", "dff.json", "Path of the optional JSON configuration file.")
+	themeFlag := flag.String("theme", "", "Report theme: detailed, compact, paths-only, or one defined in the config file.")
+	anonymizeFlag := flag.Bool("anonymize", false, "Replace user names, computer names and the config file's anonymize segments with tokens in -report and -duplicates output.")
+	columnsFlag := flag.String("columns", "", "Comma-separated report columns (id, path, computer, disk_label, size), overriding the theme.")
+	traceFlag := flag.String("trace", "", "Write a runtime trace to FILE plus CPU/heap profiles and per-phase timings next to it.")
+	debugAddrFlag := flag.String("debug-addr", "", "Serve net/http/pprof on this localhost address (e.g. :6060) while running.")
+	headlessFlag := flag.Bool("headless", false, "Print plain periodic status lines instead of redrawing progress in place.")
+	healthAddrFlag := flag.String("health-addr", "", "Serve a /healthz status endpoint on this address (e.g. :8080).")
+	hashFlag := flag.Bool("hash", true, "Hash the contents of new and changed files after walking each drive.")
+	hashAlgoFlag := flag.String("hash-algo", "", "Content hash algorithm: "+strings.Join(dedupe.Algorithms(), ", ")+" (default "+dedupe.DefaultAlgorithm+", or hash_algo in the config file). Files hashed with a different algorithm are re-hashed on the next scan.")
+	duplicatesFlag := flag.Bool("duplicates", false, "Print the duplicate sets already in the database and exit.")
+	notifyFlag := flag.Bool("notify", false, "Show a Windows notification when the scan finishes or fails.")
+	portableFlag := flag.Bool("portable", false, "Record paths relative to the volume root, keyed by volume serial, so the index survives drive letter changes.")
+	auditFlag := flag.Bool("audit", false, "Append an immutable, hash-chained scan session to the audit tables instead of updating the files table.")
+	installersFlag := flag.Bool("installers", false, "Report repeated installer versions in -installers-dir and exit.")
+	installersDirFlag := flag.String("installers-dir", defaultDownloadsDir(), "Folder checked by -installers.")
+	hashAllFlag := flag.Bool("hash-all", false, "Hash every file, not only those whose size matches another file, e.g. before an export for compare-hosts.")
+	outputFlag := flag.String("o", "", "Output file for export and report -format csv, json or ndjson (default: stdout), the folder links writes, or the plan file -dry-run writes (default: dff-plan.jsonl).")
+	formatFlag := flag.String("format", reportText, "report: text; csv for one row per copy with its group, hash, size, computer, disk label and path; json for one document; or ndjson for one group per line.")
+	topFlag := flag.Int("top", 100, "links: number of duplicate sets to link, largest waste first. history: number of actions to list.")
+	leftFlag := flag.String("left", "", "compare-hosts: export from the first machine.")
+	rightFlag := flag.String("right", "", "compare-hosts: export from the second machine.")
+	importManifestFlag := flag.String("import-manifest", "", "Import a CSV/TSV manifest (path and size columns) as a virtual volume and exit.")
+	volumeNameFlag := flag.String("volume-name", "", "Name of the virtual volume created by -import-manifest (default: the manifest file name).")
+	triageMinutesFlag := flag.Int("triage-minutes", 10, "Stop a triage session after this many minutes (0 for no limit).")
+	hashWorkersFlag := flag.Int("hash-workers", 0, "Number of files hashed at once per drive (default: 1 on spinning disks, up to 8 on SSDs).")
+	fastEnumFlag := flag.Bool("fast-enum", false, "Windows, as administrator: list whole NTFS volumes by reading the master file table instead of walking directories. Falls back to walking when the table can't be read.")
+	workersFlag := flag.Int("workers", 1, "Number of goroutines listing directories per drive. Values above 1 speed up SSD and network scans; spinning disks are usually fastest with 1.")
+	batchSizeFlag := flag.Int("batch-size", defaultInsertBatchSize, "Number of walked files written to the database per transaction.")
+	filesFromFlag := flag.String("files-from", "", "Index and hash only the paths listed in FILE, one per line (- for stdin), instead of walking the drives.")
+	keepFlag := flag.String("keep", keepNewest, "dedupe: copy to keep in each set: "+strings.Join(keepRules, ", ")+". first-in takes the folder as an argument.")
+	actionFlag := flag.String("action", dedupeDelete, "dedupe: what to do with the copies not kept: delete, or hardlink to replace them with hard links to the kept copy on the same volume.")
+	forceFlag := flag.Bool("force", false, "dedupe: delete without asking for confirmation.")
+	permanentFlag := flag.Bool("permanent", false, "dedupe: delete files outright instead of sending them to the Recycle Bin.")
+	verifyFlag := flag.String("verify", "", "dedupe, -apply-plan: full compares each copy byte by byte with the kept one right before deleting, moving or linking it.")
+	dryRunFlag := flag.Bool("dry-run", false, "dedupe, clean: write the operations to a plan file instead of carrying them out.")
+	applyPlanFlag := flag.String("apply-plan", "", "Carry out the operations in a plan file written by -dry-run.")
+	logFlag := flag.String("log", "", "apply-plan: also append everything the run prints to this file.")
+	quarantineFlag := flag.String("quarantine", "", "dedupe: move the copies not kept under this folder instead of deleting them; dff restore puts them back.")
+	auditVerifyFlag := flag.Bool("audit-verify", false, "Verify the audit session hash chain and exit.")
+	flag.CommandLine.Parse(args)
+	if err := applyEnvOverrides(flag.CommandLine); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		exit(2)
+	}
+
+	// The first SIGINT/SIGTERM stops the walk and lets the database close
+	// cleanly; a second one kills the process.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	go func() {
+		<-ctx.Done()
+		stopSignals()
+	}()
+
+	if *debugAddrFlag != "" {
+		if err := startDebugServer(*debugAddrFlag); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+	}
+
+	if *traceFlag != "" {
+		stopTracing, err := startTracing(*traceFlag)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		exitHooks = append(exitHooks, stopTracing)
+		defer stopTracing()
+	}
+
+	cfg, err := loadConfig(*configFlag)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		exit(1)
+	}
+
+	if *hashAlgoFlag == "" {
+		*hashAlgoFlag = cfg.HashAlgo
+	}
+	if *hashAlgoFlag == "" {
+		*hashAlgoFlag = dedupe.DefaultAlgorithm
+	}
+	if err := dedupe.CheckAlgorithm(*hashAlgoFlag); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		exit(2)
+	}
+
+	sidecars, err := resolveSidecars(cfg.Sidecars)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		exit(2)
+	}
+
+	strategies, err := newHashStrategies(cfg.Hashing)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		exit(2)
+	}
+
+	paths, err := newPathOrder(cfg.Locale)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		exit(2)
+	}
+
+	var privacyZones []string
+	for _, zone := range cfg.PrivacyZones {
+		abs, err := filepath.Abs(zone)
+		if err != nil {
+			fmt.Printf("[ERROR] Invalid privacy zone %s: %v\n", zone, err)
+			exit(2)
+		}
+		privacyZones = append(privacyZones, abs)
+	}
+
+	if err := checkVerifyMode(*verifyFlag); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		exit(2)
+	}
+
+	protect, err := newProtectedPaths(cfg.Protected)
+	if err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		exit(2)
+	}
+
+	roots := flag.Args()
+	if *pathFlag != "" {
+		roots = append([]string{*pathFlag}, roots...)
+	}
+
+	var anon *anonymizer
+	if *anonymizeFlag {
+		anon = newAnonymizer(cfg.Anonymize)
+	}
 
 	if *reportFlag {
-		dbPath := "files.db"
+		theme, err := resolveTheme(cfg, *themeFlag, *columnsFlag)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(2)
+		}
+		dbPath := *dbFlag
 		csvPath := "files.csv"
 		fmt.Printf("Exporting files table from %s to %s...\n", dbPath, csvPath)
-		err := exportFilesTableToCSV(dbPath, csvPath)
+		err = exportFilesTableToCSV(dbPath, *safeDBFlag, csvPath, theme, anon)
 		if err != nil {
 			fmt.Printf("[ERROR] Export failed: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 		fmt.Printf("Export successful. CSV saved to %s\n", csvPath)
 		return
 	}
 
-	db, err := setupDatabase("files.db")
+	if *duplicatesFlag || command == "report" {
+		if err := checkReportFormat(*formatFlag); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(2)
+		}
+		db, err := setupDatabase(*dbFlag, *safeDBFlag)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			exit(1)
+		}
+		defer db.Close()
+		if *formatFlag != reportText {
+			var out io.Writer = os.Stdout
+			if *outputFlag != "" {
+				file, err := os.Create(*outputFlag)
+				if err != nil {
+					fmt.Printf("[ERROR] Failed to create %s: %v\n", *outputFlag, err)
+					exit(1)
+				}
+				defer file.Close()
+				out = file
+			}
+			groups, err := writeDuplicates(db, out, *formatFlag, *hashAlgoFlag, anon, paths)
+			if err != nil {
+				fmt.Printf("[ERROR] %v\n", err)
+				exit(1)
+			}
+			if *outputFlag != "" {
+				message.NewPrinter(message.MatchLanguage("en")).Printf("Wrote %d duplicate groups to %s\n", groups, *outputFlag)
+			}
+			return
+		}
+		if err := printDuplicates(db, os.Stdout, *hashAlgoFlag, anon, sidecars, paths); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	if command == "compare-hosts" {
+		if *leftFlag == "" || *rightFlag == "" {
+			fmt.Println("compare-hosts needs both -left and -right exports, e.g. dff compare-hosts -left laptop.jsonl -right desktop.jsonl.")
+			exit(2)
+		}
+		if err := compareHosts(os.Stdout, *leftFlag, *rightFlag); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	if command == "export" {
+		db, err := setupDatabase(*dbFlag, *safeDBFlag)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			exit(1)
+		}
+		defer db.Close()
+		var out io.Writer = os.Stdout
+		if *outputFlag != "" {
+			file, err := os.Create(*outputFlag)
+			if err != nil {
+				fmt.Printf("[ERROR] Failed to create %s: %v\n", *outputFlag, err)
+				exit(1)
+			}
+			defer file.Close()
+			out = file
+		}
+		count, err := exportFiles(db, out, anon)
+		if err != nil {
+			fmt.Printf("[ERROR] Export failed: %v\n", err)
+			exit(1)
+		}
+		if *outputFlag != "" {
+			message.NewPrinter(message.MatchLanguage("en")).Printf("Exported %d files to %s\n", count, *outputFlag)
+		}
+		return
+	}
+
+	if command == "coverage" {
+		if len(roots) == 0 {
+			fmt.Println("Name the masters directories to check, e.g. dff coverage D:\\Photos.")
+			exit(2)
+		}
+		var masters []string
+		for _, root := range roots {
+			abs, err := filepath.Abs(root)
+			if err != nil {
+				fmt.Printf("[ERROR] Failed to resolve %s: %v\n", root, err)
+				exit(2)
+			}
+			masters = append(masters, abs)
+		}
+		db, err := setupDatabase(*dbFlag, *safeDBFlag)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			exit(1)
+		}
+		defer db.Close()
+		if err := printCoverage(db, os.Stdout, masters, anon, paths); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	if command == "triage" {
+		db, err := setupDatabase(*dbFlag, *safeDBFlag)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			exit(1)
+		}
+		defer db.Close()
+		if err := runTriage(db, os.Stdin, os.Stdout, *hashAlgoFlag, time.Duration(*triageMinutesFlag)*time.Minute, cfg.CompareTool); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	if *dryRunFlag && command != "dedupe" && command != "clean" {
+		fmt.Println("-dry-run can only be used with the dedupe and clean commands.")
+		exit(2)
+	}
+	planPath := *outputFlag
+	if planPath == "" {
+		planPath = "dff-plan.jsonl"
+	}
+
+	if command == "links" {
+		if *outputFlag == "" {
+			fmt.Println("Name the folder to fill with links, e.g. dff links -o D:\\Duplicates.")
+			exit(2)
+		}
+		db, err := setupDatabase(*dbFlag, *safeDBFlag)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			exit(1)
+		}
+		defer db.Close()
+		sets, links, err := writeLinkFarm(db, *outputFlag, getComputerName(), *hashAlgoFlag, *topFlag)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		message.NewPrinter(message.MatchLanguage("en")).Printf("Wrote %d links for %d duplicate sets to %s\n", links, sets, *outputFlag)
+		return
+	}
+
+	if command == "dedupe" || command == "review" {
+		folder := ""
+		if len(roots) > 0 {
+			if folder, err = filepath.Abs(roots[0]); err != nil {
+				fmt.Printf("[ERROR] Failed to resolve %s: %v\n", roots[0], err)
+				exit(2)
+			}
+		}
+		if err := checkKeepRule(*keepFlag, folder); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(2)
+		}
+		if err := checkDedupeAction(*actionFlag); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(2)
+		}
+		quarantineDir := ""
+		if *quarantineFlag != "" {
+			if *actionFlag != dedupeDelete {
+				fmt.Println("-quarantine can only be used with -action delete.")
+				exit(2)
+			}
+			if quarantineDir, err = filepath.Abs(*quarantineFlag); err != nil {
+				fmt.Printf("[ERROR] Failed to resolve %s: %v\n", *quarantineFlag, err)
+				exit(2)
+			}
+		}
+		if *actionFlag == dedupeDelete && quarantineDir == "" && !*permanentFlag && !recycleBinSupported {
+			fmt.Println("There is no Recycle Bin on this platform; pass -permanent to delete files outright.")
+			exit(2)
+		}
+		db, err := setupDatabase(*dbFlag, *safeDBFlag)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			exit(1)
+		}
+		defer db.Close()
+		computerName := getComputerName()
+		plan, undecided, err := planDedupe(db, computerName, *hashAlgoFlag, *keepFlag, folder, *actionFlag, sidecars, protect)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		rule, left := *keepFlag, len(undecided)
+		if command == "review" && len(plan)+len(undecided) > 0 {
+			plan, err = reviewDuplicates(db, os.Stdin, os.Stdout, computerName, append(plan, undecided...), *actionFlag, sidecars, protect)
+			if errors.Is(err, errQuit) {
+				fmt.Println("Nothing was changed.")
+				return
+			}
+			if err != nil {
+				fmt.Printf("[ERROR] %v\n", err)
+				exit(1)
+			}
+			rule, left = "chosen", 0
+		}
+		files, _ := printDedupePlan(os.Stdout, plan, left, rule, *actionFlag)
+		op := planRecycle
+		switch {
+		case *actionFlag == dedupeHardlink:
+			op = planHardlink
+		case quarantineDir != "":
+			op = planQuarantine
+		case *permanentFlag:
+			op = planDelete
+		}
+		if *dryRunFlag {
+			pw, err := newPlanWriter(planPath)
+			if err == nil {
+				writeDedupePlan(pw, computerName, *hashAlgoFlag, op, quarantineDir, plan)
+				err = pw.close()
+			}
+			if err != nil {
+				fmt.Printf("[ERROR] %v\n", err)
+				exit(1)
+			}
+			if err := recordArtifact(db, planPath); err != nil {
+				fmt.Printf("[ERROR] %v\n", err)
+			}
+			message.NewPrinter(message.MatchLanguage("en")).Printf("Wrote %d operations on %d bytes to %s; run dff apply-plan %s to carry them out.\n", pw.ops, pw.bytes, planPath, planPath)
+			fmt.Printf("To carry them out from a scheduled task instead:\n  %s\n", scheduledApplyCommand(planPath, *dbFlag, *configFlag))
+			return
+		}
+		if files == 0 || !*forceFlag && !confirmDedupe(os.Stdin, os.Stdout, files, *actionFlag, *permanentFlag, quarantineDir) {
+			return
+		}
+		if *actionFlag == dedupeHardlink {
+			linked, failed, reclaimed := runHardlink(db, os.Stdout, computerName, *hashAlgoFlag, plan, *verifyFlag == verifyFull)
+			message.NewPrinter(message.MatchLanguage("en")).Printf("Replaced %d files with hard links, %d bytes reclaimed, %d failed.\n", linked, reclaimed, failed)
+			if failed > 0 {
+				exit(1)
+			}
+			return
+		}
+		removeFile, done := recycleFile, "Sent %d files to the Recycle Bin, %d failed.\n"
+		switch op {
+		case planQuarantine:
+			removeFile = func(diskLabel, stored, path string) (string, error) {
+				return quarantineFile(db, quarantineDir, computerName, diskLabel, stored, path)
+			}
+			done = "Moved %d files to quarantine, %d failed.\n"
+		case planDelete:
+			removeFile, done = deleteFile, "Deleted %d files, %d failed.\n"
+		}
+		deleted, failed := runDedupe(db, os.Stdout, computerName, *hashAlgoFlag, op, plan, *verifyFlag == verifyFull, removeFile)
+		message.NewPrinter(message.MatchLanguage("en")).Printf(done, deleted, failed)
+		if failed > 0 {
+			exit(1)
+		}
+		return
+	}
+
+	if command == "history" {
+		db, err := setupDatabase(*dbFlag, *safeDBFlag)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			exit(1)
+		}
+		defer db.Close()
+		if err := printHistory(db, os.Stdout, *topFlag); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	if command == "restore" {
+		var paths []string
+		for _, root := range roots {
+			abs, err := filepath.Abs(root)
+			if err != nil {
+				fmt.Printf("[ERROR] Failed to resolve %s: %v\n", root, err)
+				exit(2)
+			}
+			paths = append(paths, abs)
+		}
+		db, err := setupDatabase(*dbFlag, *safeDBFlag)
+		if err != nil {
+			fmt.Printf("Failed to open database: %v\n", err)
+			exit(1)
+		}
+		defer db.Close()
+		_, failed, err := restoreQuarantine(db, os.Stdout, getComputerName(), paths)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		if failed > 0 {
+			exit(1)
+		}
+		return
+	}
+
+	if *applyPlanFlag != "" || command == "apply-plan" {
+		planFile := *applyPlanFlag
+		if command == "apply-plan" {
+			if len(roots) != 1 {
+				fmt.Println("Usage: dff apply-plan [flags] plan.jsonl")
+				exit(2)
+			}
+			planFile = roots[0]
+		}
+		// A scheduled task has no console to read, so -log keeps a copy of
+		// everything the run prints.
+		var out io.Writer = os.Stdout
+		if *logFlag != "" {
+			logFile, err := os.OpenFile(*logFlag, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+			if err != nil {
+				fmt.Printf("[ERROR] Failed to open log: %v\n", err)
+				exit(1)
+			}
+			defer logFile.Close()
+			out = io.MultiWriter(os.Stdout, logFile)
+			fmt.Fprintf(logFile, "\n%s: dff apply-plan %s\n", time.Now().Format(time.DateTime), planFile)
+		}
+		failed, err := func() (int, error) {
+			ops, err := loadPlan(planFile)
+			if err != nil {
+				return 0, err
+			}
+			db, err := setupDatabase(*dbFlag, *safeDBFlag)
+			if err != nil {
+				return 0, fmt.Errorf("failed to open database: %v", err)
+			}
+			defer db.Close()
+			if *logFlag != "" {
+				if err := recordArtifact(db, *logFlag); err != nil {
+					return 0, err
+				}
+			}
+			return applyPlan(db, out, getComputerName(), ops, protect, *verifyFlag == verifyFull)
+		}()
+		if err != nil {
+			fmt.Fprintf(out, "[ERROR] %v\n", err)
+			exit(1)
+		}
+		if failed > 0 {
+			exit(1)
+		}
+		return
+	}
+
+	if *installersFlag {
+		groups, err := findInstallerGroups(*installersDirFlag)
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to read %s: %v\n", *installersDirFlag, err)
+			exit(1)
+		}
+		printInstallerReport(os.Stdout, *installersDirFlag, groups)
+		return
+	}
+
+	db, err := setupDatabase(*dbFlag, *safeDBFlag)
 	if err != nil {
 		fmt.Printf("Failed to open database: %v\n", err)
 		return
 	}
 	defer db.Close()
 
+	if *importManifestFlag != "" {
+		volumeName := *volumeNameFlag
+		if volumeName == "" {
+			volumeName = strings.TrimSuffix(filepath.Base(*importManifestFlag), filepath.Ext(*importManifestFlag))
+		}
+		count, err := importManifest(db, *importManifestFlag, volumeName)
+		if err != nil {
+			fmt.Printf("[ERROR] Manifest import failed: %v\n", err)
+			exit(1)
+		}
+		message.NewPrinter(message.MatchLanguage("en")).Printf("Imported %d entries from %s as virtual volume %q\n", count, *importManifestFlag, volumeName)
+		return
+	}
+
+	if *auditVerifyFlag {
+		if err := verifyAuditChain(db, os.Stdout); err != nil {
+			fmt.Printf("[ERROR] Audit verification failed: %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	if *auditFlag && (command == "hash" || command == "clean" || command == "rescan") {
+		fmt.Printf("Audit sessions only record scans; -audit cannot be combined with the %s command.\n", command)
+		return
+	}
+	if *deleteFlag && *auditFlag {
+		fmt.Println("Audit databases are append-only; -delete-all cannot be combined with -audit.")
+		return
+	}
 	if *deleteFlag {
 		_, err := db.Exec("DELETE FROM files")
 		if err != nil {
@@ -272,7 +965,8 @@ func main() {
 		fmt.Println("All data deleted from the database.")
 	}
 
-	drives := listDrives()
+	volumes := newDriveEnumerator()
+	drives := volumes.Drives()
 	fmt.Print("Available drives: ")
 	if len(drives) > 0 {
 		fmt.Println(strings.Join(drives, ", "))
@@ -280,91 +974,392 @@ func main() {
 		fmt.Println("(none found)")
 	}
 
+	// drivesToScan holds the roots to walk, which are whole drives unless
+	// directories were given; volumeRoots maps each to the drive it lives on.
 	var drivesToScan []string
-	if *driveFlag != "" {
-		found := false
-		driveInput := strings.ToLower(strings.TrimSpace(*driveFlag))
-		if len(driveInput) > 0 {
-			driveInputLetter := driveInput[:1]
-			for _, d := range drives {
-				driveLetter := strings.ToLower(d[:1])
-				if driveLetter == driveInputLetter {
-					found = true
-					break
-				}
-			}
-		}
+	volumeRoots := map[string]string{}
+	switch {
+	case *allDrivesFlag && (*driveFlag != "" || len(roots) > 0), *driveFlag != "" && len(roots) > 0:
+		fmt.Println("Use only one of -all-drives, -drive, or -path and path arguments.")
+		exit(2)
+	case *driveFlag != "":
+		drive, found := findDrive(drives, *driveFlag)
 		if !found {
 			fmt.Printf("Drive %s not found or not available.\n", *driveFlag)
 			return
 		}
-		// Use the canonical drive name from the available drives list for scanning
-		for _, d := range drives {
-			driveLetter := strings.ToLower(d[:1])
-			if driveLetter == driveInput[:1] {
-				drivesToScan = []string{d}
-				break
+		drivesToScan = []string{drive}
+	case len(roots) > 0:
+		for _, root := range roots {
+			abs, err := filepath.Abs(root)
+			if err == nil {
+				var info os.FileInfo
+				if info, err = os.Stat(abs); err == nil && !info.IsDir() {
+					err = fmt.Errorf("not a directory")
+				}
+			}
+			if err != nil {
+				fmt.Printf("Cannot scan %s: %v\n", root, err)
+				exit(1)
+			}
+			drive := containingDrive(drives, abs)
+			if drive == "" {
+				fmt.Printf("Cannot scan %s: it is not on any available drive.\n", root)
+				exit(1)
+			}
+			if _, seen := volumeRoots[abs]; !seen {
+				drivesToScan = append(drivesToScan, abs)
+				volumeRoots[abs] = drive
 			}
 		}
-	} else {
-		drivesToScan = drives
+	default:
+		var warnings []string
+		drivesToScan, warnings = removeOverlappingDrives(drives, volumes)
+		for _, w := range warnings {
+			fmt.Println(w)
+		}
+	}
+	for _, d := range drivesToScan {
+		if volumeRoots[d] == "" {
+			volumeRoots[d] = d
+		}
 	}
+	// A scan started by a wake timer would otherwise be cut short when the
+	// machine idles back into sleep; once it's done, sleep is allowed again.
+	defer preventSleep()()
 
-	var totalFiles int
+	var listed map[string][]string
+	if *filesFromFlag != "" {
+		paths, err := readFileList(*filesFromFlag)
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+		var unmatched []string
+		listed, unmatched = assignToDrives(paths, drivesToScan)
+		for _, p := range unmatched {
+			fmt.Printf("Skipping %s: not on a drive being scanned.\n", p)
+		}
+		var withFiles []string
+		for _, d := range drivesToScan {
+			if len(listed[d]) > 0 {
+				withFiles = append(withFiles, d)
+			}
+		}
+		drivesToScan = withFiles
+	}
+
+	artifacts := artifactSet{}
+	artifacts.addDatabase(*dbFlag)
+	artifacts.add(*configFlag, "files.csv")
+	if *traceFlag != "" {
+		artifacts.add(traceOutputs(*traceFlag)...)
+	}
+	if err := artifacts.addRecorded(db); err != nil {
+		fmt.Printf("[ERROR] %v\n", err)
+		exit(1)
+	}
+	if command == "clean" && *dryRunFlag {
+		artifacts.add(planPath)
+	}
+	filter := newWalkFilter(artifacts, includeFlag, excludeFlag, modifiedAfterFlag.Time, modifiedBeforeFlag.Time)
+
+	computerName := getComputerName()
+	display := newProgressDisplay(*headlessFlag, newCPUMonitor())
+	scans := make([]*driveProgress, 0, len(drivesToScan))
 	for _, drive := range drivesToScan {
-		total, free, used, err := getDiskUsage(drive)
+		total, free, used, err := volumes.Usage(volumeRoots[drive])
 		if err != nil {
 			fmt.Printf("Error getting disk usage for %s: %v\n", drive, err)
 		} else {
 			fmt.Printf("Disk usage for %s: Total: %.2f GB, Used: %.2f GB, Free: %.2f GB\n", drive, float64(total)/1e9, float64(used)/1e9, float64(free)/1e9)
 		}
-		label := getDiskLabel(drive)
-		computerName := getComputerName()
-		fmt.Printf("Walking files: %s, %s, %s\n", computerName, label, drive)
-		done := make(chan struct{})
-		progress := make(chan int, 100)
-		var lastCount int
-		// Start a goroutine to print files processed every second
-		go func() {
-			ticker := time.NewTicker(1 * time.Second)
-			defer ticker.Stop()
-			p := message.NewPrinter(message.MatchLanguage("en"))
-			for {
-				select {
-				case <-done:
+		label := volumes.Label(volumeRoots[drive])
+		switch command {
+		case "hash":
+			fmt.Printf("Hashing files: %s, %s, %s\n", computerName, label, drive)
+		case "clean":
+			fmt.Printf("Removing missing files: %s, %s, %s\n", computerName, label, drive)
+		default:
+			if listed != nil {
+				fmt.Printf("Recording %d listed files: %s, %s, %s\n", len(listed[drive]), computerName, label, drive)
+			} else {
+				fmt.Printf("Walking files: %s, %s, %s\n", computerName, label, drive)
+			}
+		}
+		scans = append(scans, display.add(drive, label))
+	}
+
+	var audit *auditSession
+	if *auditFlag {
+		audit, err = startAuditSession(db, computerName, drivesToScan)
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to start audit session: %v\n", err)
+			return
+		}
+		fmt.Printf("Recording audit session %d\n", audit.id)
+	}
+
+	if *healthAddrFlag != "" {
+		if err := startHealthServer(*healthAddrFlag, display); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+	}
+
+	hashing := audit == nil && (command == "hash" || (command == "" || command == "rescan") && *hashFlag)
+
+	// Each drive is walked on its own goroutine so slow USB disks don't hold up
+	// the fast internal ones; the display redraws one row per drive.
+	go display.run()
+	var wg sync.WaitGroup
+	var totalFiles atomic.Int64
+	// Hashing only looks at files whose size matches another file, so it waits
+	// until every drive has been walked and all sizes are known.
+	var walking sync.WaitGroup
+	walking.Add(len(scans))
+	// Likewise the full pass of one drive matches against the quick hashes of
+	// all the others.
+	var quickHashing sync.WaitGroup
+	quickHashing.Add(len(scans))
+	// clean -dry-run writes the rows it would forget to a plan instead.
+	var cleanPlan *planWriter
+	if command == "clean" && *dryRunFlag {
+		if cleanPlan, err = newPlanWriter(planPath); err == nil {
+			err = recordArtifact(db, planPath)
+		}
+		if err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+			exit(1)
+		}
+	}
+	// Files the change journals saw being created, for pointing at what
+	// brought back a duplicate dedupe had removed.
+	var journalMu sync.Mutex
+	journalCreated := map[string]usnCreation{}
+	for _, dp := range scans {
+		wg.Add(1)
+		go func(dp *driveProgress) {
+			defer wg.Done()
+			walkDone := sync.OnceFunc(walking.Done)
+			defer walkDone()
+			quickDone := sync.OnceFunc(quickHashing.Done)
+			defer quickDone()
+			owner := computerName
+			if *portableFlag {
+				serial, err := volumes.Serial(volumeRoots[dp.drive])
+				if err != nil {
+					dp.failed.Store(true)
+					dp.done.Store(true)
+					dp.logf("[ERROR] Failed to read volume serial for %s: %v\n", dp.drive, err)
 					return
-				case c, ok := <-progress:
-					if !ok {
-						// Channel closed, print final count
-						cpu := getCPUUsageWMI()
-						p.Printf("Channel closed. Files processed: %d | %s\n", lastCount, cpu)
-						return
+				}
+				owner = portableComputerPrefix + serial
+			}
+			var record fileRecorder
+			var closeRecorder func() error
+			var scanID int64
+			var err error
+			if audit != nil {
+				record, closeRecorder, err = audit.recorder(owner, dp.label)
+			} else {
+				if command != "hash" && command != "clean" {
+					scanID, err = startScan(db, owner, dp.label, dp.drive, includeFlag, excludeFlag, modifiedAfterFlag, modifiedBeforeFlag)
+				}
+				if err == nil {
+					record, closeRecorder, err = newFileRecorder(db, owner, dp.label, scanID, *batchSizeFlag)
+				}
+			}
+			if err == nil && *portableFlag {
+				record = relativeRecorder(volumeRoots[dp.drive], record)
+			}
+			if err != nil {
+				dp.failed.Store(true)
+				dp.done.Store(true)
+				dp.logf("[ERROR] Failed to prepare insert for drive %s: %v\n", dp.drive, err)
+				return
+			}
+			defer closeRecorder()
+			// Portable rows are relative to the volume root, so that is what
+			// they are resolved against.
+			dataRoot := dp.drive
+			if *portableFlag {
+				dataRoot = volumeRoots[dp.drive]
+			}
+			if command == "clean" {
+				removed, err := pruneDrive(ctx, db, dp, owner, dp.label, dataRoot, *portableFlag, 0, cleanPlan)
+				if errors.Is(err, context.Canceled) {
+					dp.interrupted.Store(true)
+				} else if err != nil {
+					dp.failed.Store(true)
+					dp.logf("[ERROR] Error removing missing files for drive %s: %v\n", dp.drive, err)
+				}
+				done := "Removed %d missing files for drive %s\n"
+				if cleanPlan != nil {
+					done = "Would remove %d missing files for drive %s\n"
+				}
+				dp.logf("%s", message.NewPrinter(message.MatchLanguage("en")).Sprintf(done, removed, dp.drive))
+				dp.done.Store(true)
+				return
+			}
+			if command != "hash" {
+				// A drive mounted inside another one (a mounted folder, or a
+				// Linux mount point below /) is walked only as itself.
+				var nested []string
+				for _, other := range drivesToScan {
+					if other != dp.drive {
+						nested = append(nested, other)
+					}
+				}
+				// A whole volume's change journal position is taken before
+				// walking, so changes made during the walk are replayed by
+				// the next rescan.
+				var journalEnd usnCursor
+				journalErr := errUSNUnavailable
+				if audit == nil && listed == nil && dp.drive == volumeRoots[dp.drive] {
+					journalEnd, journalErr = queryUSNJournal(dp.drive)
+				}
+				journaled := false
+				var fileCount int
+				if listed != nil {
+					fileCount, err = recordFileList(ctx, listed[dp.drive], record, dp, filter)
+				} else {
+					if command == "rescan" && journalErr == nil {
+						since, found, loadErr := loadUSNCursor(db, owner, dp.label, dp.drive)
+						if loadErr != nil {
+							dp.logf("[ERROR] %v\n", loadErr)
+						} else if found {
+							changes, readErr := readUSNJournal(dp.drive, since, journalEnd)
+							if readErr == nil {
+								journalMu.Lock()
+								maps.Copy(journalCreated, changes.created)
+								journalMu.Unlock()
+								fileCount, err = applyUSNChanges(ctx, db, changes, owner, dp.label, dp.drive, volumeRoots[dp.drive], *portableFlag,
+									record, dp, filter.with(nested...), *workersFlag)
+								journaled = true
+							} else {
+								dp.logf("Walking %s instead of reading its change journal: %v\n", dp.drive, readErr)
+							}
+						}
+					}
+					enumerated := false
+					if !journaled && *fastEnumFlag && dp.drive == volumeRoots[dp.drive] {
+						fileCount, err = walkMFT(ctx, dp.drive, record, dp, filter.with(nested...))
+						enumerated = fileCount > 0 || err == nil || errors.Is(err, context.Canceled)
+						if !enumerated {
+							dp.logf("Walking %s instead of reading its master file table: %v\n", dp.drive, err)
+							err = nil
+						}
+					}
+					if !journaled && !enumerated {
+						fileCount, err = walkFiles(ctx, dp.drive, record, dp, filter.with(nested...), *workersFlag)
+					}
+				}
+				if errors.Is(err, context.Canceled) {
+					dp.interrupted.Store(true)
+				} else if err != nil {
+					dp.failed.Store(true)
+					dp.logf("[ERROR] Error walking files for drive %s: %v\n", dp.drive, err)
+				}
+				totalFiles.Add(int64(fileCount))
+				// The last batch must be written before the drive is hashed.
+				closeErr := closeRecorder()
+				if closeErr != nil {
+					dp.addError("insert", closeErr)
+					dp.logf("[ERROR] Failed to insert or update files for drive %s: %v\n", dp.drive, closeErr)
+				}
+				// Rows this walk didn't reach are checked on disk, so files
+				// under a directory that couldn't be read this time survive.
+				if command == "rescan" && listed == nil && !journaled && err == nil && closeErr == nil {
+					var removed int
+					removed, err = pruneDrive(ctx, db, dp, owner, dp.label, dataRoot, *portableFlag, scanID, nil)
+					if errors.Is(err, context.Canceled) {
+						dp.interrupted.Store(true)
+					} else if err != nil {
+						dp.failed.Store(true)
+						dp.logf("[ERROR] Error removing deleted files for drive %s: %v\n", dp.drive, err)
+					}
+					dp.logf("%s", message.NewPrinter(message.MatchLanguage("en")).Sprintf("Removed %d deleted files for drive %s\n", removed, dp.drive))
+				}
+				dp.files.Store(int64(fileCount))
+				if scanID != 0 && err == nil && closeErr == nil {
+					if finishErr := finishScan(db, scanID, int64(fileCount), dp.errors.Load()); finishErr != nil {
+						dp.logf("[ERROR] %v\n", finishErr)
+					}
+				}
+				if journalErr == nil && err == nil && closeErr == nil {
+					if saveErr := saveUSNCursor(db, owner, dp.label, dp.drive, journalEnd); saveErr != nil {
+						dp.logf("[ERROR] %v\n", saveErr)
 					}
-					lastCount = c
-				case <-ticker.C:
-					cpu := getCPUUsageWMI()
-					p.Printf("Files processed: %d | %s  \r", lastCount, cpu)
 				}
 			}
-		}()
+			dp.walked.Store(true)
+			walkDone()
+			if err == nil && hashing {
+				walking.Wait()
+				dp.startHashing()
+				workers := *hashWorkersFlag
+				if workers <= 0 {
+					workers = defaultHashWorkers(volumes, volumeRoots[dp.drive])
+				}
+				_, err = hashDrive(ctx, db, dp, owner, dp.label, dataRoot, *portableFlag, *hashAllFlag, privacyZones, *hashAlgoFlag, strategies, workers, func() {
+					quickDone()
+					quickHashing.Wait()
+				})
+				if errors.Is(err, context.Canceled) {
+					dp.interrupted.Store(true)
+				} else if err != nil {
+					dp.failed.Store(true)
+					dp.logf("[ERROR] Error hashing files for drive %s: %v\n", dp.drive, err)
+				}
+			}
+			dp.done.Store(true)
+		}(dp)
+	}
+	wg.Wait()
+	display.finish()
 
-		fileCount, err := walkFiles(drive, db, progress, computerName, label)
+	if audit != nil {
+		hash, err := audit.seal(totalFiles.Load())
 		if err != nil {
-			fmt.Printf("[ERROR] Error walking files for drive %s: %v\n", drive, err)
+			fmt.Printf("[ERROR] Failed to seal audit session %d: %v\n", audit.id, err)
+		} else {
+			fmt.Printf("Audit session %d sealed with chain hash %s\n", audit.id, hash)
 		}
-		close(progress)                    // Close progress channel after walkFiles returns
-		close(done)                        // Stop monitoring goroutine
-		time.Sleep(500 * time.Millisecond) // Give goroutine time to print final output
-		fmt.Println()                      // Newline after progress
+	}
 
-		if err != nil {
-			fmt.Printf("Finished walking with error: %v\n", err)
+	fmt.Println()
+	stats.write(os.Stdout)
+
+	if cleanPlan != nil {
+		if err := cleanPlan.close(); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
 		} else {
-			message.NewPrinter(message.MatchLanguage("en")).Printf("Finished walking files without critical errors. Files processed: %d\n", fileCount)
+			message.NewPrinter(message.MatchLanguage("en")).Printf("Wrote %d operations to %s; run dff apply-plan %s to carry them out.\n", cleanPlan.ops, planPath, planPath)
+			fmt.Printf("To carry them out from a scheduled task instead:\n  %s\n", scheduledApplyCommand(planPath, *dbFlag, *configFlag))
 		}
-		totalFiles += fileCount
 	}
-	if len(drives) > 0 {
-		message.NewPrinter(message.MatchLanguage("en")).Printf("\nAll drives processed. Total files processed: %d\n", totalFiles)
+
+	if *notifyFlag {
+		notifyScanFinished(scans, totalFiles.Load(), ctx.Err() != nil)
+	}
+
+	if hashing && ctx.Err() == nil {
+		if found, err := findRegressions(db, computerName, *hashAlgoFlag); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+		} else {
+			printRegressions(os.Stdout, found, journalCreated)
+		}
+		if err := printDuplicates(db, os.Stdout, *hashAlgoFlag, anon, sidecars, paths); err != nil {
+			fmt.Printf("[ERROR] %v\n", err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		message.NewPrinter(message.MatchLanguage("en")).Printf("\nScan interrupted. Files recorded before stopping: %d\n", totalFiles.Load())
+		return
+	}
+	if len(drives) > 0 && (command == "" || command == "scan" || command == "rescan") {
+		message.NewPrinter(message.MatchLanguage("en")).Printf("\nAll drives processed. Total files processed: %d\n", totalFiles.Load())
 	}
 }
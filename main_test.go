@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var treeFiles = flag.Int("tree-files", 10000, "Number of files in the tree BenchmarkRecordFiles walks, e.g. 1000000.")
+
+func testDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := setupDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func countFiles(t testing.TB, db *sql.DB) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestFileRecorderBatches(t *testing.T) {
+	db := testDB(t)
+	record, closeRecorder, err := newFileRecorder(db, "pc", "C", 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 7 {
+		if err := record(walkedEntry{path: fmt.Sprintf("/f%d", i), size: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two full batches are written; the seventh row waits for the close.
+	if n := countFiles(t, db); n != 6 {
+		t.Errorf("before close: %d rows, want 6", n)
+	}
+	if err := closeRecorder(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countFiles(t, db); n != 7 {
+		t.Errorf("after close: %d rows, want 7", n)
+	}
+	if err := closeRecorder(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
+
+func TestFileRecorderKeepsHashOfUnchangedFile(t *testing.T) {
+	db := testDB(t)
+	record, closeRecorder, err := newFileRecorder(db, "pc", "C", 1, defaultInsertBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(walkedEntry{path: "/same", size: 10, mtime: 100})
+	record(walkedEntry{path: "/changed", size: 10, mtime: 100})
+	if err := closeRecorder(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE files SET hash = 'h', hash_algo = 'sha256'`); err != nil {
+		t.Fatal(err)
+	}
+
+	record, closeRecorder, err = newFileRecorder(db, "pc", "C", 2, defaultInsertBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(walkedEntry{path: "/same", size: 10, mtime: 100})
+	record(walkedEntry{path: "/changed", size: 10, mtime: 200})
+	if err := closeRecorder(); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"/same": true, "/changed": false} {
+		var hash sql.NullString
+		if err := db.QueryRow(`SELECT hash FROM files WHERE path = ?`, path).Scan(&hash); err != nil {
+			t.Fatal(err)
+		}
+		if hash.Valid != want {
+			t.Errorf("%s: hash kept = %v, want %v", path, hash.Valid, want)
+		}
+	}
+}
+
+// BenchmarkRecordFiles walks a generated tree into a fresh database, once
+// committing every row and once in the default batches. The tree has 10,000
+// files unless -tree-files says otherwise:
+//
+//	go test -run XXX -bench RecordFiles -benchtime 1x -tree-files 1000000
+func BenchmarkRecordFiles(b *testing.B) {
+	root := b.TempDir()
+	const perDir = 1000
+	for i := range *treeFiles {
+		dir := filepath.Join(root, fmt.Sprintf("d%04d", i/perDir))
+		if i%perDir == 0 {
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), nil, 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, batchSize := range []int{1, defaultInsertBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			for range b.N {
+				b.StopTimer()
+				db, err := setupDatabase(filepath.Join(b.TempDir(), "bench.db"), false)
+				if err != nil {
+					b.Fatal(err)
+				}
+				record, closeRecorder, err := newFileRecorder(db, "pc", "C", 1, batchSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				n, err := walkFiles(context.Background(), root, record, nil, walkFilter{}, 1)
+				if err == nil {
+					err = closeRecorder()
+				}
+				b.StopTimer()
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Every file, every directory and the root itself.
+				if want := *treeFiles + (*treeFiles+perDir-1)/perDir + 1; n != want {
+					b.Fatalf("recorded %d entries, want %d", n, want)
+				}
+				db.Close()
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(*treeFiles)*float64(b.N)/b.Elapsed().Seconds(), "files/s")
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// manifestComputer is the computer name recorded for rows imported from a
+// manifest, so virtual volumes never collide with a real machine's drives.
+const manifestComputer = "(manifest)"
+
+// importManifest loads a CSV or tab-separated manifest exported from a disk
+// image or another tool into the files table as a virtual volume. The header
+// must name a path column and a size column, optionally a SHA-256 hash
+// column; other columns are ignored, so this tool's own files.csv export can
+// be imported as well.
+func importManifest(db *sql.DB, manifestPath, volumeName string) (int, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	if strings.HasSuffix(strings.ToLower(manifestPath), ".tsv") {
+		r.Comma = '\t'
+	}
+	header, err := r.Read()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read manifest header: %v", err)
+	}
+	pathCol, sizeCol, hashCol := -1, -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))) {
+		case "path", "fullname", "full_path", "filename":
+			pathCol = i
+		case "size", "length", "bytes":
+			sizeCol = i
+		case "hash", "sha256":
+			hashCol = i
+		}
+	}
+	if pathCol < 0 || sizeCol < 0 {
+		return 0, fmt.Errorf("manifest header must contain a path and a size column, got %v", header)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO files(path, computer, disk_label, size, hash, hash_algo) VALUES(?, ?, ?, ?, ?, ?)
+	ON CONFLICT(path, computer, disk_label) DO UPDATE SET size=excluded.size, hash=excluded.hash, hash_algo=excluded.hash_algo, removed_at=NULL`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	count := 0
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to read manifest line %d: %v", line, err)
+		}
+		if pathCol >= len(record) || sizeCol >= len(record) {
+			return count, fmt.Errorf("manifest line %d has too few columns", line)
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(record[sizeCol]), 10, 64)
+		if err != nil {
+			return count, fmt.Errorf("invalid size on manifest line %d: %v", line, err)
+		}
+		// Virtual volumes can't be read, so a SHA-256 column is the only way
+		// their rows take part in duplicate sets.
+		var hash, hashAlgo any
+		if hashCol >= 0 && hashCol < len(record) && strings.TrimSpace(record[hashCol]) != "" {
+			hash, hashAlgo = strings.ToLower(strings.TrimSpace(record[hashCol])), "sha256"
+		}
+		if _, err := stmt.Exec(record[pathCol], manifestComputer, volumeName, size, hash, hashAlgo); err != nil {
+			return count, fmt.Errorf("failed to insert manifest line %d: %v", line, err)
+		}
+		count++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
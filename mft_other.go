@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func walkMFT(ctx context.Context, drive string, record fileRecorder, progress *driveProgress, skip walkFilter) (int, error) {
+	return 0, errors.New("the master file table is only read on Windows")
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+func sendNotification(title, body, openPath string) error {
+	return errors.New("desktop notifications are only supported on Windows")
+}
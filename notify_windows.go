@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"unicode/utf16"
+)
+
+// powershellAppID is the AppUserModelID of Windows PowerShell. Toasts must be
+// raised on behalf of a registered app, and a console binary has none of its own.
+const powershellAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+// sendNotification shows a Windows toast. When openPath is set the toast gets
+// an "Open report" button that opens that file with its default application.
+func sendNotification(title, body, openPath string) error {
+	esc := func(s string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	toast := `<toast><visual><binding template="ToastGeneric"><text>` + esc(title) + `</text><text>` + esc(body) + `</text></binding></visual>`
+	if openPath != "" {
+		if abs, err := filepath.Abs(openPath); err == nil {
+			u := url.URL{Scheme: "file", Path: "/" + filepath.ToSlash(abs)}
+			toast += `<actions><action content="Open report" activationType="protocol" arguments="` + esc(u.String()) + `"/></actions>`
+		}
+	}
+	toast += `</toast>`
+
+	script := fmt.Sprintf(`[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] | Out-Null
+$doc = New-Object Windows.Data.Xml.Dom.XmlDocument
+$doc.LoadXml('%s')
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('%s').Show([Windows.UI.Notifications.ToastNotification]::new($doc))`,
+		psQuote(toast), psQuote(powershellAppID))
+
+	// -EncodedCommand takes UTF-16LE base64, which sidesteps all command-line quoting.
+	units := utf16.Encode([]rune(script))
+	raw := make([]byte, 2*len(units))
+	for i, u := range units {
+		raw[2*i], raw[2*i+1] = byte(u), byte(u>>8)
+	}
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-EncodedCommand", base64.StdEncoding.EncodeToString(raw))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("powershell failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// psQuote escapes s for use inside a single-quoted PowerShell string.
+func psQuote(s string) string {
+	return string(bytes.ReplaceAll([]byte(s), []byte("'"), []byte("''")))
+}
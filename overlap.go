@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// subtreeContains reports whether child is parent or lies beneath it.
+// Both use the volume's own separator, which may be / or \. Case is ignored
+// only on Windows and macOS, whose file systems ignore it by default. An
+// empty parent contains nothing.
+func subtreeContains(parent, child string) bool {
+	if parent == "" {
+		return false
+	}
+	parent, child = strings.TrimRight(parent, `/\`), strings.TrimRight(child, `/\`)
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		parent, child = strings.ToLower(parent), strings.ToLower(child)
+	}
+	if parent == "" || parent == child {
+		// A parent of only separators is the root of the volume.
+		return true
+	}
+	return strings.HasPrefix(child, parent) && (child[len(parent)] == '/' || child[len(parent)] == '\\')
+}
+
+// removeOverlappingDrives drops drives that expose part of a volume another
+// drive already covers, such as a subst drive pointing into D:\ or the same
+// disk bind-mounted twice, so the same files are not indexed under two paths
+// and then reported as duplicates of themselves. It returns the drives to
+// scan and one warning per drive skipped.
+func removeOverlappingDrives(drives []string, volumes driveEnumerator) ([]string, []string) {
+	type source struct {
+		drive, volume, subtree string
+		known                  bool
+	}
+	sources := make([]source, len(drives))
+	for i, d := range drives {
+		volume, subtree, err := volumes.Source(d)
+		sources[i] = source{drive: d, volume: volume, subtree: subtree, known: err == nil}
+	}
+
+	var keep, warnings []string
+	for i, s := range sources {
+		coveredBy := -1
+		if s.known {
+			for j, other := range sources {
+				if i == j || !other.known || other.volume != s.volume || !subtreeContains(other.subtree, s.subtree) {
+					continue
+				}
+				// Identical exposures keep the first drive; otherwise the wider one wins.
+				if !subtreeContains(s.subtree, other.subtree) || j < i {
+					coveredBy = j
+					break
+				}
+			}
+		}
+		if coveredBy >= 0 {
+			warnings = append(warnings, fmt.Sprintf("Skipping %s: it is the same volume as %s (showing %s), which is already being scanned.",
+				s.drive, sources[coveredBy].drive, s.subtree))
+			continue
+		}
+		keep = append(keep, s.drive)
+	}
+	return keep, warnings
+}
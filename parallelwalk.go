@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// walkedEntry is a file or directory found by a walk, waiting to be
+// recorded. Directories carry only their path. created is 0 when the
+// platform doesn't report creation times, and attrs holds the Windows
+// read-only, hidden and system bits.
+type walkedEntry struct {
+	path                 string
+	size, mtime, created int64
+	attrs                uint32
+}
+
+// statEntry describes the file at path from info.
+func statEntry(path string, info os.FileInfo) walkedEntry {
+	created, attrs := fileTimesAndAttributes(info)
+	return walkedEntry{path: path, size: info.Size(), mtime: info.ModTime().UnixNano(), created: created, attrs: attrs}
+}
+
+// dirQueue is the unbounded stack of directories still to enumerate. Workers
+// both take from it and add to it, so it can't be a plain channel without
+// risking every worker blocking on a full one.
+type dirQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	dirs   []string
+	active int // directories taken but not yet finished
+	closed bool
+}
+
+func newDirQueue(root string) *dirQueue {
+	q := &dirQueue{dirs: []string{root}}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *dirQueue) push(dirs []string) {
+	if len(dirs) == 0 {
+		return
+	}
+	q.mu.Lock()
+	q.dirs = append(q.dirs, dirs...)
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// take returns the next directory, or false once the walk is finished or
+// stopped.
+func (q *dirQueue) take() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.dirs) == 0 && q.active > 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.dirs) == 0 || q.closed {
+		q.closed = true
+		q.cond.Broadcast()
+		return "", false
+	}
+	dir := q.dirs[len(q.dirs)-1]
+	q.dirs = q.dirs[:len(q.dirs)-1]
+	q.active++
+	return dir, true
+}
+
+func (q *dirQueue) done() {
+	q.mu.Lock()
+	q.active--
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *dirQueue) stop() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// walkParallel is walkFiles with directory enumeration and stat calls spread
+// over workers goroutines. Entries are recorded on the calling goroutine, so
+// record still sees a single writer. Each directory is charged the time its
+// worker spent listing and stating it.
+func walkParallel(ctx context.Context, root string, record fileRecorder, progress *driveProgress, skip walkFilter, workers int) (int, error) {
+	entries := make(chan walkedEntry, 4096)
+	queue := newDirQueue(root)
+	stopOnCancel := context.AfterFunc(ctx, queue.stop)
+	defer stopOnCancel()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dirTimes := map[string]time.Duration{}
+			defer stats.mergeDirTimes(dirTimes)
+			for {
+				dir, ok := queue.take()
+				if !ok {
+					return
+				}
+				start := time.Now()
+				subdirs := readWalkDir(ctx, dir, entries, progress, skip)
+				dirTimes[dir] += time.Since(start)
+				queue.push(subdirs)
+				queue.done()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(entries)
+	}()
+
+	count := 0
+	if info, err := os.Lstat(root); err != nil {
+		progress.addError("walk", err)
+	} else if info.IsDir() && !skip.skips(root, true) {
+		count = recordWalked(walkedEntry{path: root}, record, progress, count)
+	}
+	for e := range entries {
+		count = recordWalked(e, record, progress, count)
+	}
+	return count, ctx.Err()
+}
+
+// readWalkDir sends the entries of dir to out and returns its subdirectories.
+func readWalkDir(ctx context.Context, dir string, out chan<- walkedEntry, progress *driveProgress, skip walkFilter) []string {
+	endWalk := phases.track(phaseWalk)
+	list, err := os.ReadDir(dir)
+	endWalk()
+	if err != nil {
+		progress.addError("walk", err)
+	}
+	var subdirs []string
+	for _, d := range list {
+		if ctx.Err() != nil {
+			return nil
+		}
+		path := filepath.Join(dir, d.Name())
+		// Symbolic links are left out, as in walkFiles.
+		if skip.skips(path, d.IsDir()) || d.Type()&os.ModeSymlink != 0 {
+			continue
+		}
+		e := walkedEntry{path: path}
+		if d.IsDir() {
+			subdirs = append(subdirs, path)
+		} else {
+			endStat := phases.track(phaseStat)
+			info, statErr := d.Info()
+			endStat()
+			if statErr == nil {
+				e = statEntry(path, info)
+			} else {
+				progress.addError("stat", statErr)
+			}
+			if skip.skipsModified(e.mtime) {
+				continue
+			}
+		}
+		select {
+		case out <- e:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return subdirs
+}
+
+// recordWalked records one entry and returns the updated file count.
+func recordWalked(e walkedEntry, record fileRecorder, progress *driveProgress, count int) int {
+	endInsert := phases.track(phaseInsert)
+	err := record(e)
+	endInsert()
+	if err != nil {
+		progress.addError("insert", err)
+		progress.logf("[ERROR] Failed to insert or update %s: %v\n", e.path, err)
+		return count
+	}
+	count++
+	progress.files.Store(int64(count))
+	return count
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// pathOrder sorts paths the way a person reads them in a file manager: by
+// the locale's collation rather than by bytes, with runs of digits compared
+// as numbers so file2 comes before file10, and folder by folder so the files
+// of one directory stay together ahead of its subdirectories.
+type pathOrder struct {
+	collator *collate.Collator
+}
+
+// newPathOrder collates for locale, a BCP 47 tag such as "sv" or "de-DE", or
+// for the user's locale when it is empty.
+func newPathOrder(locale string) (*pathOrder, error) {
+	if locale == "" {
+		locale = systemLocale()
+	}
+	tag := language.English
+	if locale != "" {
+		var err error
+		if tag, err = language.Parse(locale); err != nil {
+			return nil, fmt.Errorf("invalid locale %q: %v", locale, err)
+		}
+	}
+	return &pathOrder{collator: collate.New(tag, collate.Numeric)}, nil
+}
+
+// compare orders a before b when it returns a negative number. Paths may
+// come from other computers, so either separator splits them.
+func (o *pathOrder) compare(a, b string) int {
+	dirA, nameA := splitAnyPath(a)
+	dirB, nameB := splitAnyPath(b)
+	partsA := strings.FieldsFunc(dirA, isPathSeparator)
+	partsB := strings.FieldsFunc(dirB, isPathSeparator)
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		if c := o.collator.CompareString(partsA[i], partsB[i]); c != 0 {
+			return c
+		}
+	}
+	if len(partsA) != len(partsB) {
+		return len(partsA) - len(partsB)
+	}
+	if c := o.collator.CompareString(nameA, nameB); c != 0 {
+		return c
+	}
+	// Paths the locale treats as equal still get a fixed order.
+	return strings.Compare(a, b)
+}
+
+// sortFiles orders the copies of a set by path, then by where they were
+// recorded.
+func (o *pathOrder) sortFiles(files []duplicateFile) {
+	slices.SortStableFunc(files, func(a, b duplicateFile) int {
+		if c := o.compare(a.path, b.path); c != 0 {
+			return c
+		}
+		if a.computer != b.computer {
+			return strings.Compare(a.computer, b.computer)
+		}
+		return strings.Compare(a.diskLabel, b.diskLabel)
+	})
+}
+
+func isPathSeparator(r rune) bool { return r == '/' || r == '\\' }
+
+func splitAnyPath(path string) (dir, name string) {
+	i := strings.LastIndexAny(path, `/\`)
+	return path[:i+1], path[i+1:]
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Duplicate-File-Finder.main/dedupe"
+	"golang.org/x/text/message"
+)
+
+// Operations in a plan file. The dedupe ones mirror its actions; forget is
+// clean removing the row of a file that no longer exists.
+const (
+	planDelete     = "delete"
+	planRecycle    = "recycle"
+	planQuarantine = "quarantine"
+	planHardlink   = "hardlink"
+	planForget     = "forget"
+)
+
+// planOp is one line of a plan file written by -dry-run. Copies carry the
+// size, time and hash they were planned with, so -apply-plan can refuse files
+// that changed in between, and the kept copy of their set. A sidecar carries
+// its size and time too, but names the copy it belongs to instead of a hash. An entry for a row stored relative to its
+// volume carries the volume root its paths are found under.
+type planOp struct {
+	Op         string `json:"op"`
+	Computer   string `json:"computer"`
+	DiskLabel  string `json:"disk_label"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size,omitempty"`
+	Mtime      int64  `json:"mtime,omitempty"`
+	HashAlgo   string `json:"hash_algo,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	Keep       string `json:"keep,omitempty"`
+	KeepMtime  int64  `json:"keep_mtime,omitempty"`
+	Rule       string `json:"rule,omitempty"`
+	SidecarOf  string `json:"sidecar_of,omitempty"`
+	Quarantine string `json:"quarantine,omitempty"`
+	Root       string `json:"root,omitempty"`
+}
+
+// onDisk returns where the file recorded as path is on this computer.
+func (op planOp) onDisk(path string) string {
+	if op.Root == "" {
+		return path
+	}
+	return filepath.Join(op.Root, path)
+}
+
+// planWriter writes a plan file as JSON lines, one operation each. Drives are
+// cleaned concurrently, so writes are serialized.
+type planWriter struct {
+	mu    sync.Mutex
+	file  *os.File
+	enc   *json.Encoder
+	ops   int
+	bytes int64
+	err   error
+}
+
+func newPlanWriter(path string) (*planWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create plan file: %v", err)
+	}
+	return &planWriter{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (pw *planWriter) write(op planOp) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.err != nil {
+		return
+	}
+	if pw.err = pw.enc.Encode(op); pw.err == nil {
+		pw.ops++
+		pw.bytes += op.Size
+	}
+}
+
+// close finishes the file and returns the first error writing it.
+func (pw *planWriter) close() error {
+	if err := pw.file.Close(); err != nil && pw.err == nil {
+		pw.err = err
+	}
+	if pw.err != nil {
+		return fmt.Errorf("failed to write plan file: %v", pw.err)
+	}
+	return nil
+}
+
+// writeDedupePlan writes every operation dedupe would carry out for plan.
+func writeDedupePlan(pw *planWriter, computerName, algo, op, quarantine string, plan []dedupeSet) {
+	for _, s := range plan {
+		for _, c := range s.remove {
+			pw.write(planOp{Op: op, Computer: computerName, DiskLabel: c.diskLabel, Path: c.path, Size: c.size, Mtime: c.mtime,
+				HashAlgo: algo, Hash: s.key, Keep: s.keep.path, KeepMtime: s.keep.mtime, Rule: s.rule, Quarantine: quarantine, Root: s.root})
+			if c.sidecarsWarn {
+				continue
+			}
+			for _, sc := range c.sidecars {
+				pw.write(planOp{Op: op, Computer: computerName, DiskLabel: c.diskLabel, Path: sc.path, Size: sc.size, Mtime: sc.mtime,
+					SidecarOf: c.path, Quarantine: quarantine, Root: s.root})
+			}
+		}
+	}
+}
+
+// scheduledApplyCommand is the command line that applies planPath later,
+// for a Task Scheduler action or a cron job. Those start in another folder,
+// so every path is made absolute, and the run is logged next to the plan.
+func scheduledApplyCommand(planPath, dbPath, configPath string) string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "dff"
+	}
+	quote := func(path string) string {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		return `"` + path + `"`
+	}
+	return fmt.Sprintf("%s apply-plan -db %s -config %s -log %s %s", quote(exe), quote(dbPath), quote(configPath),
+		quote(strings.TrimSuffix(planPath, filepath.Ext(planPath))+".log"), quote(planPath))
+}
+
+// recycleFile and deleteFile are the removeFile functions runDedupe uses for
+// the recycle and delete operations.
+func recycleFile(_, _, path string) (string, error) {
+	return "Recycle Bin", moveToRecycleBin(path)
+}
+
+func deleteFile(_, _, path string) (string, error) {
+	return "", os.Remove(path)
+}
+
+func loadPlan(path string) ([]planOp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plan file: %v", err)
+	}
+	defer f.Close()
+	var ops []planOp
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var op planOp
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		switch op.Op {
+		case planDelete, planRecycle, planQuarantine, planHardlink, planForget:
+		default:
+			return nil, fmt.Errorf("%s line %d: unknown operation %q", path, line, op.Op)
+		}
+		ops = append(ops, op)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read plan file: %v", err)
+	}
+	return ops, nil
+}
+
+// applyPlan carries out the operations in a plan file, with the same checks
+// as the command that wrote it: a file that changed since it was planned is
+// left alone, a row is only forgotten while its file is still missing, and
+// nothing under a protected path is touched even if the plan lists it. Before
+// any of that, every file a dedupe operation names is hashed again, and if
+// one no longer matches the plan nothing is done at all. Nothing is done
+// either when an operation keeps the very file it removes. It returns the
+// number of operations that failed. verify is passed on to runDedupe and
+// runHardlink.
+func applyPlan(db *sql.DB, w io.Writer, computerName string, ops []planOp, protect protectedPaths, verify bool) (int, error) {
+	for _, op := range ops {
+		if op.Computer != computerName && !strings.HasPrefix(op.Computer, portableComputerPrefix) {
+			return 0, fmt.Errorf("the plan is for files on %s, not this computer", op.Computer)
+		}
+		// A copy kept as itself, or under another name for the same file,
+		// would leave no copy at all.
+		if op.Op != planForget && op.SidecarOf == "" &&
+			(op.Keep == "" || op.Keep == op.Path || sameFile(op.onDisk(op.Keep), op.onDisk(op.Path))) {
+			return 0, fmt.Errorf("the plan entry for %s names no other copy to keep; nothing was changed", op.onDisk(op.Path))
+		}
+	}
+	mismatched, err := verifyPlanHashes(w, ops)
+	if err != nil {
+		return 0, err
+	}
+	if mismatched > 0 {
+		return 0, fmt.Errorf("%d files no longer match the plan; nothing was changed", mismatched)
+	}
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	failed := 0
+
+	// Dedupe operations are regrouped into sets, one run per kind of
+	// operation and owner of the rows, in the order the plan lists them.
+	type runKey struct{ op, algo, quarantine, computer, root string }
+	var order []runKey
+	runs := map[runKey][]dedupeSet{}
+	forgotten := 0
+	// Copies kept as protected keep their sidecars too.
+	protectedCopies := map[string]bool{}
+	for _, op := range ops {
+		if op.Op == planForget {
+			path := op.onDisk(op.Path)
+			if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+				fmt.Fprintf(w, "Keeping the row for %s: the file exists again\n", path)
+				continue
+			}
+			if _, err := db.Exec("UPDATE files SET removed_at = ? WHERE computer = ? AND disk_label = ? AND path = ?",
+				time.Now().UTC().Format(time.RFC3339), op.Computer, op.DiskLabel, op.Path); err != nil {
+				fmt.Fprintf(w, "[ERROR] Failed to remove %s: %v\n", path, err)
+				failed++
+				continue
+			}
+			forgotten++
+			continue
+		}
+		if protect.protects(op.onDisk(op.Path)) || protectedCopies[op.SidecarOf] {
+			fmt.Fprintf(w, "Keeping %s: kept (protected)\n", op.onDisk(op.Path))
+			protectedCopies[op.Path] = true
+			continue
+		}
+		key := runKey{op.Op, op.HashAlgo, op.Quarantine, op.Computer, op.Root}
+		sets := runs[key]
+		if op.SidecarOf != "" {
+			for i := len(sets) - 1; i >= 0 && op.SidecarOf != ""; i-- {
+				for j, c := range sets[i].remove {
+					if c.path == op.SidecarOf {
+						sets[i].remove[j].sidecars = append(sets[i].remove[j].sidecars, sidecar{path: op.Path, size: op.Size, mtime: op.Mtime})
+						op.SidecarOf = ""
+						break
+					}
+				}
+			}
+			if op.SidecarOf != "" {
+				return 0, fmt.Errorf("the plan lists sidecar %s before the copy it belongs to", op.Path)
+			}
+			continue
+		}
+		if _, ok := runs[key]; !ok {
+			order = append(order, key)
+		}
+		c := dedupeCopy{diskLabel: op.DiskLabel, path: op.Path, size: op.Size, mtime: op.Mtime}
+		if n := len(sets); n > 0 && sets[n-1].key == op.Hash && sets[n-1].keep.path == op.Keep {
+			sets[n-1].remove = append(sets[n-1].remove, c)
+		} else {
+			keep := dedupeCopy{path: op.Keep, size: op.Size, mtime: op.KeepMtime}
+			sets = append(sets, dedupeSet{key: op.Hash, size: op.Size, keep: keep, remove: []dedupeCopy{c}, rule: op.Rule, root: op.Root})
+		}
+		runs[key] = sets
+	}
+	if forgotten > 0 {
+		p.Fprintf(w, "Marked %d missing files as removed in the database.\n", forgotten)
+	}
+
+	for _, key := range order {
+		sets := runs[key]
+		switch key.op {
+		case planHardlink:
+			linked, n, reclaimed := runHardlink(db, w, key.computer, key.algo, sets, verify)
+			p.Fprintf(w, "Replaced %d files with hard links, %d bytes reclaimed, %d failed.\n", linked, reclaimed, n)
+			failed += n
+		case planQuarantine:
+			removed, n := runDedupe(db, w, key.computer, key.algo, planQuarantine, sets, verify, func(diskLabel, stored, path string) (string, error) {
+				return quarantineFile(db, key.quarantine, key.computer, diskLabel, stored, path)
+			})
+			p.Fprintf(w, "Moved %d files to quarantine, %d failed.\n", removed, n)
+			failed += n
+		case planRecycle:
+			removed, n := runDedupe(db, w, key.computer, key.algo, planRecycle, sets, verify, recycleFile)
+			p.Fprintf(w, "Sent %d files to the Recycle Bin, %d failed.\n", removed, n)
+			failed += n
+		case planDelete:
+			removed, n := runDedupe(db, w, key.computer, key.algo, planDelete, sets, verify, deleteFile)
+			p.Fprintf(w, "Deleted %d files, %d failed.\n", removed, n)
+			failed += n
+		}
+	}
+	return failed, nil
+}
+
+// verifyPlanHashes hashes each copy a dedupe operation removes or links, and
+// the copy it keeps, and lists the ones whose content no longer matches the
+// hash in the plan or that can't be read. A plan may be applied long after it
+// was reviewed, by a scheduled task, so any difference means it no longer
+// describes the files. Sidecars carry no hash and are checked by size and
+// time right before they are removed. It returns the number of files listed.
+func verifyPlanHashes(w io.Writer, ops []planOp) (int, error) {
+	type checked struct{ algo, path string }
+	hashes := map[checked]string{}
+	mismatched := 0
+	for _, op := range ops {
+		if op.Op == planForget || op.HashAlgo == "" {
+			continue
+		}
+		if err := dedupe.CheckAlgorithm(op.HashAlgo); err != nil {
+			return 0, fmt.Errorf("the plan entry for %s: %v", op.Path, err)
+		}
+		for _, path := range []string{op.onDisk(op.Path), op.onDisk(op.Keep)} {
+			c := checked{op.HashAlgo, path}
+			if _, done := hashes[c]; done {
+				continue
+			}
+			hash, _, err := hashFile(path, op.HashAlgo, 0, new(atomic.Int64))
+			hashes[c] = hash
+			switch {
+			case err != nil:
+				fmt.Fprintf(w, "[ERROR] %s no longer matches the plan: %v\n", path, err)
+			case hash != op.Hash:
+				fmt.Fprintf(w, "[ERROR] %s no longer matches the plan: its content changed\n", path)
+			default:
+				continue
+			}
+			mismatched++
+		}
+	}
+	return mismatched, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyPlanRefusesToKeepTheRemovedFile(t *testing.T) {
+	dir := t.TempDir()
+	path, link := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if err := os.WriteFile(path, []byte("only copy"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(path, link); err != nil {
+		t.Skip(err)
+	}
+	db := testDB(t)
+	for _, keep := range []string{path, link} {
+		op := planOp{Op: planDelete, Computer: "pc", Path: path, Size: 9, HashAlgo: "sha256", Keep: keep}
+		if _, err := applyPlan(db, io.Discard, "pc", []planOp{op}, protectedPaths{}, false); err == nil {
+			t.Errorf("keeping %s while deleting %s was allowed", keep, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
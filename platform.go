@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// driveEnumerator finds the volumes that can be scanned and describes them.
+// Each platform provides its own implementation via newDriveEnumerator.
+type driveEnumerator interface {
+	Drives() []string
+	Usage(drive string) (total, free, used uint64, err error)
+	Label(drive string) string
+	// Serial identifies the volume itself, independent of where it is mounted.
+	Serial(drive string) (string, error)
+	// Source identifies the underlying volume and the directory within it that
+	// drive exposes, so a subst drive or bind mount can be matched to its parent.
+	Source(drive string) (volume, subtree string, err error)
+	// Rotational reports whether drive is on a spinning disk, where reading
+	// several files at once only adds seeks.
+	Rotational(drive string) (bool, error)
+}
+
+// Windows file attribute bits kept in the attributes column. Other platforms
+// map hidden dot files and files without write permission onto the same bits.
+const (
+	fileAttributeReadonly = 0x1
+	fileAttributeHidden   = 0x2
+	fileAttributeSystem   = 0x4
+
+	recordedAttributes = fileAttributeReadonly | fileAttributeHidden | fileAttributeSystem
+)
+
+// cpuMonitor samples total processor load in percent. Implementations
+// return an error when their counters are unavailable on this machine.
+type cpuMonitor interface {
+	Usage() (uint64, error)
+}
+
+var errCPUUsageUnavailable = errors.New("CPU usage not available")
+
+// fallbackCPUMonitor asks each monitor in turn and permanently drops one as
+// soon as it fails, so a broken counter source is only tried once.
+type fallbackCPUMonitor struct {
+	mu       sync.Mutex
+	monitors []cpuMonitor
+}
+
+func (f *fallbackCPUMonitor) Usage() (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.monitors) > 0 {
+		pct, err := f.monitors[0].Usage()
+		if err == nil {
+			return pct, nil
+		}
+		f.monitors = f.monitors[1:]
+	}
+	return 0, errCPUUsageUnavailable
+}
+
+func formatCPUUsage(m cpuMonitor) string {
+	pct, err := m.Usage()
+	if err != nil {
+		return "CPU Usage: N/A"
+	}
+	return fmt.Sprintf("CPU Usage: %d%%", pct)
+}
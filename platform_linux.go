@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// pseudoFilesystems are mount types that never hold user files worth indexing.
+var pseudoFilesystems = map[string]bool{
+	"proc": true, "sysfs": true, "devtmpfs": true, "devpts": true, "tmpfs": true,
+	"cgroup": true, "cgroup2": true, "mqueue": true, "overlay": true, "securityfs": true,
+	"debugfs": true, "tracefs": true, "pstore": true, "bpf": true, "configfs": true,
+	"fusectl": true, "hugetlbfs": true, "autofs": true, "binfmt_misc": true, "nsfs": true,
+	"squashfs": true, "ramfs": true, "rpc_pipefs": true, "efivarfs": true,
+}
+
+// mountDrives treats the mount points of real filesystems as drives, which
+// inside a container are the volumes mounted into it.
+type mountDrives struct{}
+
+func newDriveEnumerator() driveEnumerator {
+	return mountDrives{}
+}
+
+func (mountDrives) Drives() []string {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return []string{"/"}
+	}
+	defer f.Close()
+
+	drives := []string{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || pseudoFilesystems[fields[2]] {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[1])
+		if seen[mountPoint] {
+			continue
+		}
+		// Docker bind-mounts single files such as /etc/hosts; only directories are drives.
+		if info, err := os.Stat(mountPoint); err != nil || !info.IsDir() {
+			continue
+		}
+		seen[mountPoint] = true
+		drives = append(drives, mountPoint)
+	}
+	return drives
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for space) used in /proc/mounts.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func (mountDrives) Usage(path string) (total, free, used uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return
+	}
+	total = st.Blocks * uint64(st.Bsize)
+	free = st.Bfree * uint64(st.Bsize)
+	used = total - free
+	return
+}
+
+// Label uses the mount point, since that is what a container's volume
+// configuration keeps stable across restarts.
+func (mountDrives) Label(drive string) string {
+	return drive
+}
+
+// Serial returns the filesystem ID reported by statfs, which stays the same
+// wherever the filesystem is mounted.
+func (mountDrives) Serial(drive string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(drive, &st); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%08X-%08X", uint32(st.Fsid.X__val[0]), uint32(st.Fsid.X__val[1])), nil
+}
+
+// Source reads /proc/self/mountinfo, whose device and root fields say which
+// filesystem a mount point shows and which directory of it is bind-mounted.
+func (mountDrives) Source(drive string) (volume, subtree string, err error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if unescapeMountPath(fields[4]) == drive {
+			// Later entries for the same mount point shadow earlier ones.
+			volume, subtree = fields[2], unescapeMountPath(fields[3])
+		}
+	}
+	if volume == "" {
+		return "", "", fmt.Errorf("%s not found in mountinfo", drive)
+	}
+	return volume, subtree, scanner.Err()
+}
+
+// Rotational reads the queue/rotational flag of the block device behind drive.
+// Partitions keep the flag on their parent disk.
+func (m mountDrives) Rotational(drive string) (bool, error) {
+	device, _, err := m.Source(drive)
+	if err != nil {
+		return false, err
+	}
+	for _, path := range []string{"/sys/dev/block/" + device + "/queue/rotational", "/sys/dev/block/" + device + "/../queue/rotational"} {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return strings.TrimSpace(string(data)) == "1", nil
+		}
+	}
+	return false, fmt.Errorf("no block device found for %s", drive)
+}
+
+func newCPUMonitor() cpuMonitor {
+	return &fallbackCPUMonitor{monitors: []cpuMonitor{&procStatCPUMonitor{}}}
+}
+
+// procStatCPUMonitor reports load since the previous sample (or since boot on
+// the first call) from the aggregate cpu line of /proc/stat.
+type procStatCPUMonitor struct {
+	idle, total uint64
+}
+
+func (m *procStatCPUMonitor) Usage() (uint64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, errCPUUsageUnavailable
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, errCPUUsageUnavailable
+	}
+	var idle, total uint64
+	for i, field := range fields[1:] {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			continue
+		}
+		total += v
+		// idle and iowait
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	deltaIdle, deltaTotal := idle-m.idle, total-m.total
+	m.idle, m.total = idle, total
+	if deltaTotal == 0 {
+		return 0, nil
+	}
+	return 100 * (deltaTotal - deltaIdle) / deltaTotal, nil
+}
+
+// enableVirtualTerminal reports whether stdout is a terminal that understands
+// ANSI escapes.
+func enableVirtualTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// preventSleep is a no-op on Linux; run the scan under systemd-inhibit to hold
+// off sleep.
+func preventSleep() (release func()) {
+	return func() {}
+}
+
+// fileCreated returns 0: Linux exposes birth times only through statx, which
+// the syscall package doesn't wrap.
+func fileCreated(f *os.File) int64 {
+	return 0
+}
+
+// fileTimesAndAttributes returns no creation time, which a directory listing doesn't carry here, and
+// derives the hidden and read-only bits from the name and permissions.
+func fileTimesAndAttributes(info os.FileInfo) (created int64, attrs uint32) {
+	if strings.HasPrefix(info.Name(), ".") {
+		attrs |= fileAttributeHidden
+	}
+	if info.Mode().Perm()&0o222 == 0 {
+		attrs |= fileAttributeReadonly
+	}
+	return 0, attrs
+}
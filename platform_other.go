@@ -0,0 +1,73 @@
+//go:build !windows && !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// rootDrive is the fallback for platforms without a dedicated volume layer:
+// the filesystem root is the only drive and usage figures are unavailable.
+type rootDrive struct{}
+
+func newDriveEnumerator() driveEnumerator {
+	return rootDrive{}
+}
+
+func (rootDrive) Drives() []string {
+	return []string{"/"}
+}
+
+func (rootDrive) Usage(path string) (total, free, used uint64, err error) {
+	return 0, 0, 0, errors.New("disk usage is not supported on this platform")
+}
+
+func (rootDrive) Label(drive string) string {
+	return drive
+}
+
+func (rootDrive) Serial(drive string) (string, error) {
+	return "", errors.New("volume serial numbers are not supported on this platform")
+}
+
+func (rootDrive) Source(drive string) (volume, subtree string, err error) {
+	return drive, "/", nil
+}
+
+func (rootDrive) Rotational(drive string) (bool, error) {
+	return false, errors.New("drive types are not supported on this platform")
+}
+
+func newCPUMonitor() cpuMonitor {
+	return &fallbackCPUMonitor{}
+}
+
+func enableVirtualTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// preventSleep is a no-op here; on macOS, run the scan under caffeinate -i to
+// hold off sleep.
+func preventSleep() (release func()) {
+	return func() {}
+}
+
+// fileCreated returns 0; creation times are only read on Windows.
+func fileCreated(f *os.File) int64 {
+	return 0
+}
+
+// fileTimesAndAttributes returns no creation time, which isn't read on this platform, and
+// derives the hidden and read-only bits from the name and permissions.
+func fileTimesAndAttributes(info os.FileInfo) (created int64, attrs uint32) {
+	if strings.HasPrefix(info.Name(), ".") {
+		attrs |= fileAttributeHidden
+	}
+	if info.Mode().Perm()&0o222 == 0 {
+		attrs |= fileAttributeReadonly
+	}
+	return 0, attrs
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/StackExchange/wmi"
+)
+
+const enableVirtualTerminalProcessing = 0x0004
+
+const fileBasicInfo = 0
+
+const (
+	esContinuous     = 0x80000000
+	esSystemRequired = 0x00000001
+)
+
+type windowsDrives struct{}
+
+func newDriveEnumerator() driveEnumerator {
+	return windowsDrives{}
+}
+
+func (windowsDrives) Drives() []string {
+	drives := []string{}
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	getLogicalDrives := kernel32.NewProc("GetLogicalDrives")
+
+	ret, _, _ := getLogicalDrives.Call()
+	for i := 0; i < 26; i++ {
+		if ret&(1<<uint(i)) != 0 {
+			drives = append(drives, fmt.Sprintf("%c:\\", 'A'+i))
+		}
+	}
+	return drives
+}
+
+func (windowsDrives) Usage(path string) (total, free, used uint64, err error) {
+	var freeBytesAvailable, totalNumberOfBytes, totalNumberOfFreeBytes int64
+	dll := syscall.NewLazyDLL("kernel32.dll")
+	proc := dll.NewProc("GetDiskFreeSpaceExW")
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return
+	}
+	r1, _, e1 := proc.Call(
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(&freeBytesAvailable)),
+		uintptr(unsafe.Pointer(&totalNumberOfBytes)),
+		uintptr(unsafe.Pointer(&totalNumberOfFreeBytes)),
+	)
+	if r1 == 0 {
+		err = e1
+		return
+	}
+	total = uint64(totalNumberOfBytes)
+	free = uint64(totalNumberOfFreeBytes)
+	used = total - free
+	return
+}
+
+// volumeInformation returns the volume label and serial number of the volume
+// that contains drive.
+func volumeInformation(drive string) (label string, serial uint32, err error) {
+	var volumeName [256]uint16
+	var fsName [256]uint16
+	var maxComponentLen, fileSysFlags uint32
+	driveRoot := drive[0:3]
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	getVolumeInformationW := kernel32.NewProc("GetVolumeInformationW")
+	ptr, _ := syscall.UTF16PtrFromString(driveRoot)
+	ret, _, e1 := getVolumeInformationW.Call(
+		uintptr(unsafe.Pointer(ptr)),
+		uintptr(unsafe.Pointer(&volumeName[0])),
+		uintptr(len(volumeName)),
+		uintptr(unsafe.Pointer(&serial)),
+		uintptr(unsafe.Pointer(&maxComponentLen)),
+		uintptr(unsafe.Pointer(&fileSysFlags)),
+		uintptr(unsafe.Pointer(&fsName[0])),
+		uintptr(len(fsName)),
+	)
+	if ret == 0 {
+		return "", 0, e1
+	}
+	return syscall.UTF16ToString(volumeName[:]), serial, nil
+}
+
+func (windowsDrives) Label(drive string) string {
+	label, _, err := volumeInformation(drive)
+	if err != nil {
+		return ""
+	}
+	return label
+}
+
+// Serial returns the volume serial number in the XXXX-XXXX form shown by dir and vol.
+func (windowsDrives) Serial(drive string) (string, error) {
+	_, serial, err := volumeInformation(drive)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04X-%04X", serial>>16, serial&0xFFFF), nil
+}
+
+// Source uses the volume serial as the volume identity. Drives created with
+// subst resolve through QueryDosDevice to a \??\D:\folder target, which gives
+// the subtree they expose; every other drive exposes the volume root.
+func (d windowsDrives) Source(drive string) (volume, subtree string, err error) {
+	if volume, err = d.Serial(drive); err != nil {
+		return "", "", err
+	}
+	subtree = `\`
+	var target [1024]uint16
+	queryDosDeviceW := syscall.NewLazyDLL("kernel32.dll").NewProc("QueryDosDeviceW")
+	namePtr, _ := syscall.UTF16PtrFromString(drive[0:2])
+	ret, _, _ := queryDosDeviceW.Call(uintptr(unsafe.Pointer(namePtr)), uintptr(unsafe.Pointer(&target[0])), uintptr(len(target)))
+	if ret != 0 {
+		t := syscall.UTF16ToString(target[:])
+		if strings.HasPrefix(t, `\??\`) && len(t) >= 6 && t[5] == ':' {
+			subtree = t[6:]
+			if subtree == "" {
+				subtree = `\`
+			}
+		}
+	}
+	return volume, subtree, nil
+}
+
+const (
+	ioctlStorageQueryProperty        = 0x2D1400
+	storageDeviceSeekPenaltyProperty = 7
+)
+
+// Rotational asks the storage driver whether the volume incurs a seek
+// penalty, which is how Windows itself tells hard disks from SSDs.
+func (windowsDrives) Rotational(drive string) (bool, error) {
+	name, err := syscall.UTF16PtrFromString(`\\.\` + drive[0:2])
+	if err != nil {
+		return false, err
+	}
+	h, err := syscall.CreateFile(name, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.CloseHandle(h)
+	query := struct {
+		PropertyID, QueryType uint32
+		AdditionalParameters  [4]byte
+	}{PropertyID: storageDeviceSeekPenaltyProperty}
+	var desc struct {
+		Version, Size     uint32
+		IncursSeekPenalty byte
+		_                 [3]byte
+	}
+	var returned uint32
+	err = syscall.DeviceIoControl(h, ioctlStorageQueryProperty,
+		(*byte)(unsafe.Pointer(&query)), uint32(unsafe.Sizeof(query)),
+		(*byte)(unsafe.Pointer(&desc)), uint32(unsafe.Sizeof(desc)), &returned, nil)
+	if err != nil {
+		return false, err
+	}
+	return desc.IncursSeekPenalty != 0, nil
+}
+
+// newCPUMonitor prefers the WMI performance counters and falls back to
+// GetSystemTimes, which exists on every Windows build including ARM devices
+// where WMI is missing the processor counters.
+func newCPUMonitor() cpuMonitor {
+	return &fallbackCPUMonitor{monitors: []cpuMonitor{wmiCPUMonitor{}, &systemTimesCPUMonitor{}}}
+}
+
+type Win32_PerfFormattedData_PerfOS_Processor struct {
+	Name                 string
+	PercentProcessorTime uint64
+}
+
+type wmiCPUMonitor struct{}
+
+func (wmiCPUMonitor) Usage() (uint64, error) {
+	var dst []Win32_PerfFormattedData_PerfOS_Processor
+	err := wmi.Query("SELECT Name, PercentProcessorTime FROM Win32_PerfFormattedData_PerfOS_Processor WHERE Name = '_Total'", &dst)
+	if err != nil {
+		return 0, fmt.Errorf("error getting CPU usage via WMI: %v", err)
+	}
+	if len(dst) == 0 {
+		return 0, errCPUUsageUnavailable
+	}
+	return dst[0].PercentProcessorTime, nil
+}
+
+// systemTimesCPUMonitor reports load since the previous sample (or since boot
+// on the first call) from the kernel's idle/kernel/user time counters.
+type systemTimesCPUMonitor struct {
+	idle, total uint64
+}
+
+func (m *systemTimesCPUMonitor) Usage() (uint64, error) {
+	var idle, kernel, user syscall.Filetime
+	getSystemTimes := syscall.NewLazyDLL("kernel32.dll").NewProc("GetSystemTimes")
+	if err := getSystemTimes.Find(); err != nil {
+		return 0, err
+	}
+	ret, _, e1 := getSystemTimes.Call(
+		uintptr(unsafe.Pointer(&idle)),
+		uintptr(unsafe.Pointer(&kernel)),
+		uintptr(unsafe.Pointer(&user)),
+	)
+	if ret == 0 {
+		return 0, e1
+	}
+	toUint := func(ft syscall.Filetime) uint64 { return uint64(ft.HighDateTime)<<32 | uint64(ft.LowDateTime) }
+	// Kernel time includes idle time.
+	idleNow, totalNow := toUint(idle), toUint(kernel)+toUint(user)
+	deltaIdle, deltaTotal := idleNow-m.idle, totalNow-m.total
+	m.idle, m.total = idleNow, totalNow
+	if deltaTotal == 0 {
+		return 0, nil
+	}
+	return 100 * (deltaTotal - deltaIdle) / deltaTotal, nil
+}
+
+// enableVirtualTerminal turns on ANSI escape handling for the console so
+// rows can be redrawn in place. It returns false when stdout is not a console.
+func enableVirtualTerminal() bool {
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	getConsoleMode := kernel32.NewProc("GetConsoleMode")
+	setConsoleMode := kernel32.NewProc("SetConsoleMode")
+	var mode uint32
+	ret, _, _ := getConsoleMode.Call(uintptr(syscall.Stdout), uintptr(unsafe.Pointer(&mode)))
+	if ret == 0 {
+		return false
+	}
+	ret, _, _ = setConsoleMode.Call(uintptr(syscall.Stdout), uintptr(mode|enableVirtualTerminalProcessing))
+	return ret != 0
+}
+
+// preventSleep keeps the system from idling into sleep until release is
+// called. The execution state belongs to a thread, so it is held by a
+// goroutine locked to its own thread, which clears it again on release.
+func preventSleep() (release func()) {
+	setThreadExecutionState := syscall.NewLazyDLL("kernel32.dll").NewProc("SetThreadExecutionState")
+	done := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		setThreadExecutionState.Call(esContinuous | esSystemRequired)
+		<-done
+		setThreadExecutionState.Call(esContinuous)
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// fileCreated reads the creation time from the file itself with
+// GetFileInformationByHandleEx, rather than from the directory entry, which
+// NTFS doesn't always keep current. It returns Unix nanoseconds, or 0.
+func fileCreated(f *os.File) int64 {
+	var info struct {
+		CreationTime, LastAccessTime, LastWriteTime, ChangeTime int64
+		FileAttributes                                          uint32
+		_                                                       uint32
+	}
+	getFileInformationByHandleEx := syscall.NewLazyDLL("kernel32.dll").NewProc("GetFileInformationByHandleEx")
+	ret, _, _ := getFileInformationByHandleEx.Call(f.Fd(), fileBasicInfo, uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info))
+	if ret == 0 || info.CreationTime == 0 {
+		return 0
+	}
+	ft := syscall.Filetime{LowDateTime: uint32(info.CreationTime), HighDateTime: uint32(info.CreationTime >> 32)}
+	return ft.Nanoseconds()
+}
+
+// fileTimesAndAttributes takes the creation time and attributes from the
+// directory entry. Hashing replaces the creation time with the one read from
+// the file itself.
+func fileTimesAndAttributes(info os.FileInfo) (created int64, attrs uint32) {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return 0, 0
+	}
+	return data.CreationTime.Nanoseconds(), data.FileAttributes & recordedAttributes
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// markPrivacyZones flags the rows under root that lie inside one of zones, such
+// as a password manager's vault folder, and drops any hash stored for them.
+// Flagged files are indexed by size only and never opened. Rows that have left
+// every zone are unflagged so they are hashed again.
+func markPrivacyZones(db *sql.DB, computerName, diskLabel, root string, relative bool, zones []string) error {
+	prefix := root
+	if relative {
+		prefix = ""
+	}
+	if _, err := db.Exec(`UPDATE files SET private = 0
+		WHERE computer = ? AND disk_label = ? AND substr(path, 1, ?) = ? AND private != 0`,
+		computerName, diskLabel, len(prefix), prefix); err != nil {
+		return fmt.Errorf("failed to reset privacy zones: %v", err)
+	}
+	mark, err := db.Prepare(`UPDATE files SET private = 1, hash = NULL, quick_hash = NULL, hash_algo = NULL
+		WHERE computer = ?1 AND disk_label = ?2
+		AND (?3 = '' OR lower(path) = lower(?3) OR lower(substr(path, 1, length(?3) + 1)) = lower(?3 || ?4))`)
+	if err != nil {
+		return err
+	}
+	defer mark.Close()
+	for _, zone := range zones {
+		var stored string
+		switch {
+		case subtreeContains(zone, root):
+			// The whole drive or directory being hashed is private.
+			stored = prefix
+		case subtreeContains(root, zone):
+			stored = zone
+			if relative {
+				if stored, err = filepath.Rel(root, zone); err != nil {
+					continue
+				}
+			}
+		default:
+			continue
+		}
+		stored = strings.TrimRight(stored, `/\`)
+		if _, err := mark.Exec(computerName, diskLabel, stored, string(os.PathSeparator)); err != nil {
+			return fmt.Errorf("failed to mark privacy zone %s: %v", zone, err)
+		}
+	}
+	return nil
+}
+
+// privateDuplicates groups files in privacy zones with every other file of
+// the same size. Their content was never read, so these are size-only
+// matches that have to be checked by hand. Files already in a set hashed
+// with algo are accounted for there and left out.
+func privateDuplicates(db *sql.DB, algo string) ([]duplicateSet, error) {
+	rows, err := db.Query(`SELECT size, COALESCE(computer, ''), COALESCE(disk_label, ''), path FROM files f
+		WHERE removed_at IS NULL AND size IN (SELECT size FROM files WHERE private = 1 AND size > 0 AND removed_at IS NULL)
+		AND NOT (hash IS NOT NULL AND hash_algo = ?1 AND EXISTS (SELECT 1 FROM files o
+			WHERE o.hash = f.hash AND o.size = f.size AND o.hash_algo = ?1 AND o.id != f.id AND o.removed_at IS NULL))
+		ORDER BY size, private DESC, path`, algo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query files in privacy zones: %v", err)
+	}
+	defer rows.Close()
+	var sets []duplicateSet
+	for rows.Next() {
+		var size int64
+		var f duplicateFile
+		if err := rows.Scan(&size, &f.computer, &f.diskLabel, &f.path); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if len(sets) == 0 || sets[len(sets)-1].size != size {
+			sets = append(sets, duplicateSet{size: size})
+		}
+		sets[len(sets)-1].files = append(sets[len(sets)-1].files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %v", err)
+	}
+	return slices.DeleteFunc(sets, func(s duplicateSet) bool { return len(s.files) < 2 }), nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/text/message"
+)
+
+// driveProgress holds the live counters for a single drive scan.
+type driveProgress struct {
+	drive       string
+	label       string
+	files       atomic.Int64
+	errors      atomic.Int64
+	walked      atomic.Bool
+	hashing     atomic.Bool
+	hashed      atomic.Int64
+	bytesRead   atomic.Int64
+	done        atomic.Bool
+	failed      atomic.Bool
+	interrupted atomic.Bool
+	display     *progressDisplay
+
+	// Rate sampling state, only touched by the display while holding its mutex.
+	walkRate rateSampler
+	hashRate rateSampler
+}
+
+// rateSampler turns a growing counter into a per-second rate.
+type rateSampler struct {
+	start, lastAt time.Time
+	last          int64
+}
+
+// sample returns the rate since the previous sample, or the average since
+// the first sample when average is set.
+func (r *rateSampler) sample(value int64, now time.Time, average bool) float64 {
+	if r.start.IsZero() {
+		r.start, r.lastAt = now, now
+	}
+	since, base := r.lastAt, r.last
+	if average {
+		since, base = r.start, 0
+	}
+	r.last, r.lastAt = value, now
+	elapsed := now.Sub(since).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(value-base) / elapsed
+}
+
+// startHashing switches the row to the hashing phase and starts its
+// throughput clock.
+func (dp *driveProgress) startHashing() {
+	if dp.display != nil {
+		dp.display.mu.Lock()
+		dp.hashRate.sample(0, time.Now(), false)
+		dp.display.mu.Unlock()
+	}
+	dp.hashing.Store(true)
+}
+
+func (dp *driveProgress) status() string {
+	switch {
+	case dp.failed.Load():
+		return "failed"
+	case dp.interrupted.Load():
+		return "interrupted"
+	case dp.done.Load():
+		return "done"
+	case dp.hashing.Load():
+		return "hashing"
+	}
+	return "scanning"
+}
+
+// addError counts err in the run's summary and against this drive's scan.
+func (dp *driveProgress) addError(stage string, err error) {
+	stats.addError(stage, err)
+	if dp != nil {
+		dp.errors.Add(1)
+	}
+}
+
+// logf prints a message without corrupting the progress rows below it.
+func (dp *driveProgress) logf(format string, args ...any) {
+	if dp == nil || dp.display == nil {
+		fmt.Printf(format, args...)
+		return
+	}
+	dp.display.logf(format, args...)
+}
+
+// progressDisplay renders one row per drive plus an aggregate totals row,
+// redrawing them in place once per second. When stdout is not a terminal, or
+// in headless mode, it prints plain status lines every headlessInterval instead.
+type progressDisplay struct {
+	mu          sync.Mutex
+	rows        []*driveProgress
+	drawn       int
+	interactive bool
+	printer     *message.Printer
+	cpu         cpuMonitor
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+const headlessInterval = 30 * time.Second
+
+func newProgressDisplay(headless bool, cpu cpuMonitor) *progressDisplay {
+	return &progressDisplay{
+		interactive: !headless && enableVirtualTerminal(),
+		cpu:         cpu,
+		printer:     message.NewPrinter(message.MatchLanguage("en")),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+}
+
+func (pd *progressDisplay) add(drive, label string) *driveProgress {
+	dp := &driveProgress{drive: drive, label: label, display: pd}
+	dp.walkRate.sample(0, time.Now(), false)
+	pd.mu.Lock()
+	pd.rows = append(pd.rows, dp)
+	pd.mu.Unlock()
+	return dp
+}
+
+func (pd *progressDisplay) logf(format string, args ...any) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.clear()
+	fmt.Printf(format, args...)
+}
+
+// clear erases the currently drawn rows. The caller must hold pd.mu.
+func (pd *progressDisplay) clear() {
+	if pd.drawn > 0 {
+		fmt.Printf("\033[%dA\033[J", pd.drawn)
+		pd.drawn = 0
+	}
+}
+
+// totals returns the files processed across all drives and whether every
+// drive has finished.
+func (pd *progressDisplay) totals() (files int64, finished bool) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	finished = true
+	for _, dp := range pd.rows {
+		files += dp.files.Load()
+		finished = finished && dp.done.Load()
+	}
+	return files, finished
+}
+
+func (pd *progressDisplay) draw(cpu string) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.clear()
+	prefix, eol := "", "\033[K\n"
+	if !pd.interactive {
+		prefix, eol = time.Now().Format("2006-01-02 15:04:05 "), "\n"
+	}
+	now := time.Now()
+	var files, hashed, bytesRead int64
+	// While any drive is still busy the totals show the combined current rate;
+	// once every drive is finished they show the sum of per-drive averages.
+	var walkRate, hashRate, walkAvg, hashAvg float64
+	anyHashing, allWalked, allDone := false, true, true
+	for _, dp := range pd.rows {
+		f, h, b := dp.files.Load(), dp.hashed.Load(), dp.bytesRead.Load()
+		files, hashed, bytesRead = files+f, hashed+h, bytesRead+b
+		walked, hashing, done := dp.walked.Load(), dp.hashing.Load(), dp.done.Load()
+		fr := dp.walkRate.sample(f, now, walked)
+		if walked {
+			walkAvg += fr
+		} else {
+			walkRate += fr
+			allWalked = false
+		}
+		allDone = allDone && done
+		pd.printer.Printf("%s%s [%s] Files processed: %d | %.0f files/s", prefix, dp.drive, dp.label, f, fr)
+		if hashing || h > 0 {
+			anyHashing = true
+			br := dp.hashRate.sample(b, now, done)
+			if done {
+				hashAvg += br
+			} else {
+				hashRate += br
+			}
+			pd.printer.Printf(" | Hashed: %d | %.1f MB/s | %.2f GB read", h, br/1e6, float64(b)/1e9)
+		}
+		pd.printer.Printf(" (%s)%s", dp.status(), eol)
+	}
+	if allWalked {
+		walkRate = walkAvg
+	}
+	if allDone {
+		hashRate = hashAvg
+	}
+	pd.printer.Printf("%sTotal: Files processed: %d | %.0f files/s", prefix, files, walkRate)
+	if anyHashing {
+		pd.printer.Printf(" | Hashed: %d | %.1f MB/s | %.2f GB read", hashed, hashRate/1e6, float64(bytesRead)/1e9)
+	}
+	pd.printer.Printf(" | %s%s", cpu, eol)
+	if pd.interactive {
+		pd.drawn = len(pd.rows) + 1
+	}
+}
+
+// run redraws the rows every second until finish is called.
+func (pd *progressDisplay) run() {
+	defer close(pd.stopped)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	lastPlain := time.Now()
+	for {
+		select {
+		case <-pd.stop:
+			pd.draw(formatCPUUsage(pd.cpu))
+			return
+		case now := <-ticker.C:
+			if pd.interactive {
+				pd.draw(formatCPUUsage(pd.cpu))
+			} else if now.Sub(lastPlain) >= headlessInterval {
+				pd.draw(formatCPUUsage(pd.cpu))
+				lastPlain = now
+			}
+		}
+	}
+}
+
+// finish stops the redraw loop and leaves the final rows on screen.
+func (pd *progressDisplay) finish() {
+	close(pd.stop)
+	<-pd.stopped
+}
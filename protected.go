@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// protectedPaths are the folders and patterns no cleanup may touch, such as
+// C:\Windows or a Lightroom originals folder. An entry with a glob character
+// or a "re:" prefix is a pattern, matched like -exclude; anything else is a
+// folder that protects everything under it.
+type protectedPaths struct {
+	dirs     []string
+	patterns []pathPattern
+}
+
+func newProtectedPaths(entries []string) (protectedPaths, error) {
+	var p protectedPaths
+	for _, e := range entries {
+		if strings.HasPrefix(e, "re:") || strings.ContainsAny(e, "*?[") {
+			pattern, err := compilePattern(e)
+			if err != nil {
+				return p, fmt.Errorf("invalid protected pattern: %v", err)
+			}
+			p.patterns = append(p.patterns, pattern)
+			continue
+		}
+		abs, err := filepath.Abs(e)
+		if err != nil {
+			return p, fmt.Errorf("invalid protected folder %s: %v", e, err)
+		}
+		p.dirs = append(p.dirs, abs)
+	}
+	return p, nil
+}
+
+// protects reports whether path is under a protected folder or matches a
+// protected pattern.
+func (p protectedPaths) protects(path string) bool {
+	for _, dir := range p.dirs {
+		if subtreeContains(dir, path) {
+			return true
+		}
+	}
+	for _, pattern := range p.patterns {
+		if pattern.matches(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/message"
+)
+
+// quarantineFile moves the file at path into root, under the same directory
+// structure it had, and records where it came from so restoreQuarantine can
+// put it back. Its index row, hash included, is kept in the quarantine table.
+// stored is the path its row is recorded under, which is relative for a row
+// recorded with -portable. It returns the path the file was moved to.
+func quarantineFile(db *sql.DB, root, computerName, diskLabel, stored, path string) (string, error) {
+	dest := filepath.Join(root, quarantineRelPath(path))
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(dest); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		// An earlier copy of the same path is still in quarantine.
+		dest = filepath.Join(root, quarantineRelPath(path)) + "~" + strconv.Itoa(n)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", err
+	}
+	if err := moveFile(path, dest); err != nil {
+		return "", err
+	}
+	_, err := db.Exec(`INSERT INTO quarantine(computer, disk_label, path, quarantine_path, size, mtime, hash, hash_algo, moved_at)
+		SELECT computer, disk_label, path, ?, size, mtime, hash, hash_algo, ? FROM files
+		WHERE computer = ? AND disk_label = ? AND path = ?`,
+		dest, time.Now().UTC().Format(time.RFC3339), computerName, diskLabel, stored)
+	if err != nil {
+		return dest, fmt.Errorf("moved to %s but failed to record it: %v", dest, err)
+	}
+	return dest, nil
+}
+
+// quarantineRelPath turns an absolute path into one relative to the
+// quarantine root: D:\Photos\a.jpg becomes D\Photos\a.jpg, and
+// \\server\share\a.jpg becomes server_share\a.jpg.
+func quarantineRelPath(path string) string {
+	volume := filepath.VolumeName(path)
+	rest := strings.TrimLeft(path[len(volume):], `/\`)
+	volume = strings.Trim(strings.NewReplacer(":", "", `\`, "_", "/", "_").Replace(volume), "_")
+	if volume == "" {
+		return rest
+	}
+	return filepath.Join(volume, rest)
+}
+
+// quarantineRoot returns the folder quarantineFile moved path into as dest,
+// or dest itself when the two don't line up, as for a relative path.
+func quarantineRoot(path, dest string) string {
+	rel := quarantineRelPath(path)
+	trimmed := dest
+	if i := strings.LastIndex(trimmed, "~"); i >= 0 && !strings.HasSuffix(trimmed, rel) {
+		if _, err := strconv.Atoi(trimmed[i+1:]); err == nil {
+			trimmed = trimmed[:i]
+		}
+	}
+	root, ok := strings.CutSuffix(trimmed, rel)
+	if !ok || root == "" || !isPathSeparator(rune(root[len(root)-1])) {
+		return dest
+	}
+	return root
+}
+
+// moveFile renames src to dest, copying and removing it when they are on
+// different volumes. The modification time is kept either way.
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	os.Chtimes(dest, info.ModTime(), info.ModTime())
+	in.Close()
+	if err := os.Remove(src); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return nil
+}
+
+// restoreQuarantine moves quarantined files on this computer back to where
+// they came from and puts their rows back in the index. With paths, only files
+// that came from those paths or from under them are restored. A file is left
+// in quarantine when something now exists at its original path.
+func restoreQuarantine(db *sql.DB, w io.Writer, computerName string, paths []string) (int, int, error) {
+	type entry struct {
+		id                                    int64
+		diskLabel, path, dest, hashAlgo, hash string
+		size                                  int64
+	}
+	rows, err := db.Query(`SELECT id, COALESCE(disk_label, ''), path, quarantine_path, COALESCE(hash_algo, ''), COALESCE(hash, ''), COALESCE(size, 0)
+		FROM quarantine WHERE computer = ? ORDER BY id`, computerName)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query quarantine: %v", err)
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.diskLabel, &e.path, &e.dest, &e.hashAlgo, &e.hash, &e.size); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan row: %v", err)
+		}
+		selected := len(paths) == 0
+		for _, p := range paths {
+			if subtreeContains(p, e.path) {
+				selected = true
+			}
+		}
+		if selected {
+			entries = append(entries, e)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	restored, failed := 0, 0
+	for _, e := range entries {
+		if _, err := os.Lstat(e.path); !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(w, "Leaving %s in quarantine: %s exists again\n", e.dest, e.path)
+			failed++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(e.path), 0o755); err != nil {
+			fmt.Fprintf(w, "[ERROR] Failed to restore %s: %v\n", e.path, err)
+			failed++
+			continue
+		}
+		if err := moveFile(e.dest, e.path); err != nil {
+			fmt.Fprintf(w, "[ERROR] Failed to restore %s: %v\n", e.path, err)
+			failed++
+			continue
+		}
+		restored++
+		a := cleanupAction{computer: computerName, diskLabel: e.diskLabel, action: "restore", path: e.dest, target: e.path,
+			hashAlgo: e.hashAlgo, hash: e.hash, bytes: e.size, rule: "dff restore"}
+		if err := recordAction(db, a); err != nil {
+			fmt.Fprintf(w, "[ERROR] %v\n", err)
+		}
+		// A row a later scan marked removed comes back with the restored file.
+		_, err := db.Exec(`INSERT INTO files(path, computer, disk_label, size, mtime, hash, hash_algo)
+			SELECT path, computer, disk_label, size, mtime, hash, hash_algo FROM quarantine WHERE id = ?
+			ON CONFLICT(path, computer, disk_label) DO UPDATE SET size = excluded.size, mtime = excluded.mtime,
+				hash = excluded.hash, hash_algo = excluded.hash_algo, removed_at = NULL
+			WHERE files.removed_at IS NOT NULL`, e.id)
+		if err == nil {
+			_, err = db.Exec("DELETE FROM quarantine WHERE id = ?", e.id)
+		}
+		// A restored copy is wanted, so it isn't a duplicate that came back.
+		if err == nil {
+			_, err = db.Exec("DELETE FROM resolved_copies WHERE computer = ? AND disk_label = ? AND path = ?", computerName, e.diskLabel, e.path)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "[ERROR] Restored %s but failed to update the index: %v\n", e.path, err)
+		}
+	}
+	message.NewPrinter(message.MatchLanguage("en")).Fprintf(w, "Restored %d files, %d left in quarantine.\n", restored, failed)
+	return restored, failed, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestQuarantineRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "q")
+	path := filepath.Join(t.TempDir(), "photos", "a.jpg")
+	dest := filepath.Join(root, quarantineRelPath(path))
+	for _, tc := range []struct{ path, dest, want string }{
+		{path, dest, root + string(filepath.Separator)},
+		{path, dest + "~2", root + string(filepath.Separator)},
+		// A relative path from a -portable drive doesn't line up with dest.
+		{"photos/b.jpg", dest, dest},
+	} {
+		if got := quarantineRoot(tc.path, tc.dest); got != tc.want {
+			t.Errorf("quarantineRoot(%q, %q) = %q, want %q", tc.path, tc.dest, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+const recycleBinSupported = false
+
+func moveToRecycleBin(path string) error {
+	return errors.New("the Recycle Bin is only available on Windows")
+}
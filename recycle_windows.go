@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	foDelete           = 0x3
+	fofSilent          = 0x4
+	fofNoConfirmation  = 0x10
+	fofAllowUndo       = 0x40
+	fofNoErrorUI       = 0x400
+	fofWantNukeWarning = 0x4000
+)
+
+const driveFixed = 3
+
+const recycleBinSupported = true
+
+// moveToRecycleBin sends path to the Recycle Bin with SHFileOperationW, so a
+// deletion can be undone from Explorer. Only fixed drives have a Recycle Bin;
+// elsewhere Windows would delete the file outright, so it is refused. The one
+// dialog shown is Windows' own warning when the file would still be deleted
+// outright, as on a drive whose Recycle Bin is turned off.
+func moveToRecycleBin(path string) error {
+	ok, err := hasRecycleBin(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not on a drive with a Recycle Bin, so it would be deleted outright; pass -permanent to do that", path)
+	}
+	from, err := syscall.UTF16FromString(path)
+	if err != nil {
+		return err
+	}
+	// pFrom is a list of paths ended by an empty one.
+	from = append(from, 0)
+	ret, aborted := shFileOperation(foDelete, from, fofAllowUndo|fofNoConfirmation|fofSilent|fofNoErrorUI|fofWantNukeWarning)
+	if ret != 0 {
+		return fmt.Errorf("SHFileOperation failed with code 0x%X", ret)
+	}
+	if aborted {
+		return fmt.Errorf("moving to the Recycle Bin was aborted")
+	}
+	return nil
+}
+
+// hasRecycleBin reports whether the volume holding path is a fixed drive.
+// Removable drives and network shares have no Recycle Bin.
+func hasRecycleBin(path string) (bool, error) {
+	root, err := volumePathName(path)
+	if err != nil {
+		return false, err
+	}
+	name, err := syscall.UTF16PtrFromString(root)
+	if err != nil {
+		return false, err
+	}
+	driveType, _, _ := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDriveTypeW").Call(uintptr(unsafe.Pointer(name)))
+	return driveType == driveFixed, nil
+}
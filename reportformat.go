@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Output formats for report. text is the readable listing printDuplicates
+// writes; csv has one row per copy for filtering in a spreadsheet; json is
+// one document and ndjson one group per line, for other programs.
+const (
+	reportText   = "text"
+	reportCSV    = "csv"
+	reportJSON   = "json"
+	reportNDJSON = "ndjson"
+)
+
+func checkReportFormat(format string) error {
+	switch format {
+	case reportText, reportCSV, reportJSON, reportNDJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown report format %q (want %s, %s, %s or %s)", format, reportText, reportCSV, reportJSON, reportNDJSON)
+}
+
+// What a duplicate set's copies were matched on, for the match field.
+const (
+	matchHash   = "hash"
+	matchSample = "sampled hash"
+	matchName   = "size and name"
+	matchSize   = "size only"
+)
+
+// reportGroup is one duplicate set in the csv, json and ndjson reports.
+// Groups are numbered in the order report lists them, so group 3 is
+// "Duplicate set 3" in the text report. Hash is empty unless the copies were
+// matched on it.
+type reportGroup struct {
+	Group       int          `json:"group"`
+	Match       string       `json:"match"`
+	HashAlgo    string       `json:"hash_algo,omitempty"`
+	Hash        string       `json:"hash,omitempty"`
+	Size        int64        `json:"size"`
+	Reclaimable int64        `json:"reclaimable"`
+	Copies      []reportCopy `json:"copies"`
+}
+
+type reportCopy struct {
+	Computer  string `json:"computer"`
+	DiskLabel string `json:"disk_label"`
+	Path      string `json:"path"`
+}
+
+// reportGroups returns the sets from duplicateSets as report groups, with
+// names passed through anon.
+func reportGroups(db *sql.DB, algo string, anon *anonymizer, paths *pathOrder) ([]reportGroup, error) {
+	hashed, unhashed, private, err := duplicateSets(db, algo, paths)
+	if err != nil {
+		return nil, err
+	}
+	var groups []reportGroup
+	for _, kind := range []struct {
+		match string
+		sets  []duplicateSet
+	}{{matchHash, hashed}, {matchName, unhashed}, {matchSize, private}} {
+		for _, s := range kind.sets {
+			g := reportGroup{Group: len(groups) + 1, Match: kind.match, Size: s.size, Reclaimable: s.waste()}
+			if kind.match == matchHash {
+				g.HashAlgo, g.Hash = algo, s.key
+				if sampled, ok := strings.CutPrefix(s.key, samplePrefix); ok {
+					g.Match, g.Hash = matchSample, sampled
+				}
+			}
+			for _, f := range s.files {
+				g.Copies = append(g.Copies, reportCopy{anon.computer(f.computer), anon.path(f.diskLabel), anon.path(f.path)})
+			}
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// writeDuplicates writes the duplicate groups to w in format, which is any
+// format but text. It returns the number of groups.
+func writeDuplicates(db *sql.DB, w io.Writer, format, algo string, anon *anonymizer, paths *pathOrder) (int, error) {
+	groups, err := reportGroups(db, algo, anon, paths)
+	if err != nil {
+		return 0, err
+	}
+	switch format {
+	case reportCSV:
+		err = writeGroupsCSV(w, groups)
+	case reportJSON:
+		doc := struct {
+			HashAlgo    string        `json:"hash_algo"`
+			Groups      []reportGroup `json:"groups"`
+			Reclaimable int64         `json:"reclaimable"`
+		}{HashAlgo: algo, Groups: groups}
+		if doc.Groups == nil {
+			doc.Groups = []reportGroup{}
+		}
+		// Size-only matches are guesses, so they stay out of the total.
+		for _, g := range groups {
+			if g.Match != matchSize {
+				doc.Reclaimable += g.Reclaimable
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(doc)
+	case reportNDJSON:
+		out := bufio.NewWriter(w)
+		enc := json.NewEncoder(out)
+		for _, g := range groups {
+			if err = enc.Encode(g); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = out.Flush()
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to write %s report: %v", format, err)
+	}
+	return len(groups), nil
+}
+
+// writeGroupsCSV writes one row per copy, for filtering in a spreadsheet.
+func writeGroupsCSV(w io.Writer, groups []reportGroup) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"group", "match", "hash_algo", "hash", "size", "computer", "disk_label", "path"})
+	for _, g := range groups {
+		for _, c := range g.Copies {
+			cw.Write([]string{strconv.Itoa(g.Group), g.Match, g.HashAlgo, g.Hash, strconv.FormatInt(g.Size, 10),
+				c.Computer, c.DiskLabel, c.Path})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
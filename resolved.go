@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/text/message"
+)
+
+// resolvedSchema remembers every copy dedupe removed or linked, so a later
+// scan can tell when a duplicate that was cleaned up has come back.
+const resolvedSchema = `
+CREATE TABLE IF NOT EXISTS resolved_copies (
+	computer TEXT NOT NULL,
+	disk_label TEXT NOT NULL,
+	path TEXT NOT NULL,
+	hash_algo TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	keep_path TEXT NOT NULL,
+	resolved_at TEXT NOT NULL,
+	PRIMARY KEY (computer, disk_label, path)
+);`
+
+func recordResolved(db *sql.DB, computerName, algo string, s dedupeSet, c dedupeCopy, action string) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO resolved_copies(computer, disk_label, path, hash_algo, hash, size, action, keep_path, resolved_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`, computerName, c.diskLabel, c.path, algo, s.key, s.size, action, s.keep.path,
+		time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to record %s as resolved: %v", c.path, err)
+	}
+	return nil
+}
+
+// regression is a copy dedupe dealt with that is a duplicate again: a
+// removed copy is back at its old path with the same content, or a linked
+// copy is no longer a hard link to the kept one.
+type regression struct {
+	path, keepPath, action, resolvedAt string
+	created                            int64
+}
+
+// findRegressions checks the copies dedupe resolved on this computer against
+// the index, which must be freshly scanned and hashed for the answer to mean
+// anything.
+func findRegressions(db *sql.DB, computerName, algo string) ([]regression, error) {
+	rows, err := db.Query(`SELECT r.path, r.keep_path, r.action, r.resolved_at, COALESCE(f.created, 0)
+		FROM resolved_copies r
+		JOIN files f ON f.computer = r.computer AND f.disk_label = r.disk_label AND f.path = r.path
+			AND f.hash_algo = r.hash_algo AND f.hash = r.hash AND f.size = r.size AND f.removed_at IS NULL
+		WHERE r.computer = ? AND r.hash_algo = ?
+		ORDER BY r.path`, computerName, algo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query resolved copies: %v", err)
+	}
+	defer rows.Close()
+	var found []regression
+	for rows.Next() {
+		var r regression
+		if err := rows.Scan(&r.path, &r.keepPath, &r.action, &r.resolvedAt, &r.created); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		// A linked path is expected to be in the index; it has only regressed
+		// when it stopped being the same file as the kept copy.
+		if r.action == dedupeHardlink && sameFile(r.path, r.keepPath) {
+			continue
+		}
+		found = append(found, r)
+	}
+	return found, rows.Err()
+}
+
+// printRegressions lists the duplicates that came back after dedupe. created
+// holds what the change journal knows about files created since the last
+// scan, keyed by path; it is empty where no journal was read.
+func printRegressions(w io.Writer, found []regression, created map[string]usnCreation) {
+	if len(found) == 0 {
+		return
+	}
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	p.Fprintf(w, "\n%d duplicates came back after dedupe:\n", len(found))
+	for _, r := range found {
+		if r.action == dedupeHardlink {
+			fmt.Fprintf(w, "  %s is no longer a hard link to %s (linked %s)\n", r.path, r.keepPath, r.resolvedAt)
+		} else {
+			fmt.Fprintf(w, "  %s is a copy of %s again (%s %s)\n", r.path, r.keepPath, removedVerbs[r.action], r.resolvedAt)
+		}
+		if c, ok := created[r.path]; ok {
+			fmt.Fprintf(w, "    created %s by %s, according to the change journal\n", c.at.Format(time.DateTime), c.source())
+		} else if r.created != 0 {
+			fmt.Fprintf(w, "    created %s\n", time.Unix(0, r.created).Format(time.DateTime))
+		}
+	}
+	fmt.Fprintln(w, "Run dff dedupe again to remove them, or look at what re-created them first.")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+	"golang.org/x/text/message"
+)
+
+// reviewSet is one duplicate set on the review screen. copies starts with the
+// copy the -keep rule picked, followed by the ones it would remove; when the
+// rule couldn't decide, planned has no rule and no copy is suggested. chosen
+// is the copy to keep, or -1 while the set is left alone. answered is set
+// once the user has chosen a copy or left the set alone on purpose, which
+// every undecided set needs before the choices can be applied.
+type reviewSet struct {
+	planned  dedupeSet
+	copies   []dedupeCopy
+	chosen   int
+	answered bool
+}
+
+// reviewState is the review screen: the sets, the one being shown and the
+// copy the cursor is on, and a notice to show with it.
+type reviewState struct {
+	sets            []reviewSet
+	current, cursor int
+	action          string
+	notice          string
+}
+
+func newReviewState(plan []dedupeSet, action string) *reviewState {
+	st := &reviewState{action: action}
+	for _, s := range plan {
+		if len(s.remove) == 0 {
+			continue
+		}
+		copies := append([]dedupeCopy{s.keep}, s.remove...)
+		st.sets = append(st.sets, reviewSet{planned: s, copies: copies, chosen: -1})
+	}
+	return st
+}
+
+// handle applies one key press and reports whether the review is over, and if
+// so whether the choices should be carried out.
+func (st *reviewState) handle(key string) (done, apply bool) {
+	s := &st.sets[st.current]
+	st.notice = ""
+	switch key {
+	case "up", "k":
+		st.cursor = max(st.cursor-1, 0)
+	case "down", "j":
+		st.cursor = min(st.cursor+1, len(s.copies)-1)
+	case "right", "n", "pgdn":
+		st.move(1)
+	case "left", "p", "pgup":
+		st.move(-1)
+	case "enter", " ":
+		s.chosen, s.answered = st.cursor, true
+		st.move(1)
+	case "u":
+		s.chosen, s.answered = -1, true
+	case "x":
+		for i, other := range st.sets {
+			if other.planned.rule == "" && !other.answered {
+				st.move(i - st.current)
+				st.notice = "This set has no suggested copy: choose one with enter or leave it alone with u before applying."
+				return false, false
+			}
+		}
+		return true, true
+	case "q", "ctrl-c":
+		return true, false
+	}
+	return false, false
+}
+
+func (st *reviewState) move(by int) {
+	next := min(max(st.current+by, 0), len(st.sets)-1)
+	if next != st.current {
+		st.current, st.cursor = next, 0
+		if chosen := st.sets[next].chosen; chosen >= 0 {
+			st.cursor = chosen
+		}
+	}
+}
+
+// totals returns the number of sets with a copy chosen and the files and
+// bytes they would remove, sidecars left out.
+func (st *reviewState) totals() (sets, files int, bytes int64) {
+	for _, s := range st.sets {
+		if s.chosen >= 0 {
+			sets++
+			files += len(s.copies) - 1
+			bytes += s.planned.size * int64(len(s.copies)-1)
+		}
+	}
+	return sets, files, bytes
+}
+
+func (st *reviewState) render(w io.Writer) {
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	s := st.sets[st.current]
+	verb := "delete"
+	if st.action == dedupeHardlink {
+		verb = "link"
+	}
+	fmt.Fprint(w, "\033[H\033[2J")
+	p.Fprintf(w, "Set %d of %d: %d copies of %d bytes, %d bytes reclaimable\n\n", st.current+1, len(st.sets),
+		len(s.copies)+len(s.planned.protected), s.planned.size, s.planned.size*int64(len(s.copies)-1))
+	for i, c := range s.copies {
+		pointer, mark := "  ", ""
+		if i == st.cursor {
+			pointer = "> "
+		}
+		if s.chosen == i {
+			mark = "keep"
+		} else if s.chosen >= 0 {
+			mark = verb
+		}
+		modified := ""
+		if c.mtime != 0 {
+			modified = "  modified " + time.Unix(0, c.mtime).Format("2006-01-02 15:04")
+		}
+		extra := ""
+		if i == 0 && s.planned.rule != "" {
+			extra = "  (suggested: " + s.planned.rule + ")"
+		}
+		if len(c.sidecars) > 0 {
+			extra += fmt.Sprintf("  +%d sidecars", len(c.sidecars))
+		}
+		fmt.Fprintf(w, "%s%-6s %s%s%s\n", pointer, mark, c.path, modified, extra)
+	}
+	for _, c := range s.planned.protected {
+		fmt.Fprintf(w, "  %-6s %s (protected)\n", "kept", c.path)
+	}
+	sets, files, bytes := st.totals()
+	if s.planned.rule == "" && !s.answered {
+		fmt.Fprintln(w, "\nThe keep rule couldn't pick a copy here; choose one or leave the set alone.")
+	}
+	p.Fprintf(w, "\n%d of %d sets decided: %d files and %d bytes to %s.\n", sets, len(st.sets), files, bytes, verb)
+	if st.notice != "" {
+		fmt.Fprintln(w, st.notice)
+	}
+	fmt.Fprintln(w, "up/down choose a copy, enter keep it, u leave the set alone, left/right previous/next set, x apply, q quit")
+}
+
+// readKey reads one key press from a terminal in raw mode, turning the escape
+// sequences for the arrow and page keys into names.
+func readKey(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch b {
+	case '\r', '\n':
+		return "enter", nil
+	case 3:
+		return "ctrl-c", nil
+	case 0x1b:
+		if r.Buffered() < 2 {
+			return "esc", nil
+		}
+		seq, _ := r.Peek(2)
+		if seq[0] != '[' {
+			return "esc", nil
+		}
+		r.Discard(2)
+		switch seq[1] {
+		case 'A':
+			return "up", nil
+		case 'B':
+			return "down", nil
+		case 'C':
+			return "right", nil
+		case 'D':
+			return "left", nil
+		case '5', '6':
+			r.ReadByte() // the closing ~
+			if seq[1] == '5' {
+				return "pgup", nil
+			}
+			return "pgdn", nil
+		}
+		return "esc", nil
+	}
+	return strings.ToLower(string(rune(b))), nil
+}
+
+// crlfWriter ends lines with \r\n, which a terminal in raw mode needs to
+// return to the first column.
+type crlfWriter struct{ w io.Writer }
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// errQuit is returned by reviewDuplicates when the user quits without
+// applying their choices.
+var errQuit = errors.New("review quit without changes")
+
+// reviewDuplicates shows the planned sets one at a time on the terminal and
+// lets the user choose which copy of each to keep. Sets the keep rule
+// couldn't decide come with no copy suggested and must be decided or left
+// alone before the choices are applied. It returns the plan for
+// the sets they decided, with every other copy to be removed, which is empty
+// when there was nothing to review or they decided no set. It returns errQuit
+// when they quit.
+func reviewDuplicates(db *sql.DB, in *os.File, out io.Writer, computerName string, plan []dedupeSet, action string,
+	sidecars sidecarConfig, protect protectedPaths) ([]dedupeSet, error) {
+	st := newReviewState(plan, action)
+	if len(st.sets) == 0 {
+		return nil, nil
+	}
+	fd := int(in.Fd())
+	if !term.IsTerminal(fd) || !enableVirtualTerminal() {
+		return nil, errors.New("review needs an interactive terminal; use dedupe in scripts")
+	}
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up the terminal: %v", err)
+	}
+	screen := crlfWriter{out}
+	keys := bufio.NewReader(in)
+	apply := false
+	for done := false; !done; {
+		st.render(screen)
+		key, err := readKey(keys)
+		if err != nil {
+			term.Restore(fd, old)
+			return nil, err
+		}
+		done, apply = st.handle(key)
+	}
+	term.Restore(fd, old)
+	fmt.Fprint(out, "\033[H\033[2J")
+	if !apply {
+		return nil, errQuit
+	}
+
+	var chosen []dedupeSet
+	for _, s := range st.sets {
+		if s.chosen < 0 {
+			continue
+		}
+		d := dedupeSet{key: s.planned.key, size: s.planned.size, keep: s.copies[s.chosen], protected: s.planned.protected, rule: "review"}
+		for i, c := range s.copies {
+			switch {
+			case i == s.chosen:
+			case i > 0 || action == dedupeHardlink:
+				// Copies the rule would have removed already carry their sidecars.
+				d.remove = append(d.remove, c)
+			case protect.protects(c.path):
+				d.protected = append(d.protected, c)
+			default:
+				if err := planRemoval(db, computerName, sidecars, protect, &d, c); err != nil {
+					return nil, err
+				}
+			}
+		}
+		chosen = append(chosen, d)
+	}
+	return chosen, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// migration is one step in the evolution of files.db. Steps run in order,
+// each in its own transaction, and the schema_version table records how many
+// have been applied.
+type migration struct {
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations must only ever be appended to: a step that has shipped is never
+// changed, and neither is a schema constant such as triageSchema that a step
+// runs, since databases that already applied it would not see the change. A
+// later change to the same table is a new step. The steps up to the
+// attributes column predate schema_version, so they tolerate databases that
+// already have some of their changes, and so does "add row checksums" for the
+// column db enable-checksums used to add; every other step can assume it runs
+// exactly once.
+var migrations = []migration{
+	{"create files table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS files (
+			id INTEGER PRIMARY KEY,
+			path TEXT NOT NULL,
+			computer TEXT,
+			disk_label TEXT,
+			size INTEGER,
+			UNIQUE(path, computer, disk_label)
+		)`)
+		return err
+	}},
+	{"add content hashes", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "files", "hash", "TEXT")
+	}},
+	{"record hash algorithm", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "files", "hash_algo", "TEXT"); err != nil {
+			return err
+		}
+		// Hashes stored before hash_algo existed were all SHA-256.
+		_, err := tx.Exec("UPDATE files SET hash_algo = 'sha256' WHERE hash IS NOT NULL AND hash_algo IS NULL")
+		return err
+	}},
+	{"add quick hashes", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "files", "quick_hash", "TEXT")
+	}},
+	{"add times and scan ids", func(tx *sql.Tx) error {
+		for _, column := range []string{"mtime", "scan_id", "created"} {
+			if err := addColumnIfMissing(tx, "files", column, "INTEGER"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"add privacy zones", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "files", "private", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{"add file attributes", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "files", "attributes", "INTEGER")
+	}},
+	{"index hashes and sizes", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("CREATE INDEX IF NOT EXISTS files_hash ON files(hash, size)"); err != nil {
+			return err
+		}
+		// Candidate filtering looks files up by size and then by quick hash.
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS files_size ON files(size, quick_hash)")
+		return err
+	}},
+	{"create scans and journal tables", func(tx *sql.Tx) error {
+		for _, schema := range []string{scansSchema, usnSchema} {
+			if _, err := tx.Exec(schema); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"collapse rows without a computer or label", func(tx *sql.Tx) error {
+		// UNIQUE(path, computer, disk_label) treats NULLs as distinct, so rows
+		// written without a computer or disk label could repeat. Keep the most
+		// recent of each and store '' instead, which the constraint does cover.
+		if _, err := tx.Exec(`DELETE FROM files WHERE id NOT IN (
+			SELECT MAX(id) FROM files GROUP BY COALESCE(computer, ''), COALESCE(disk_label, ''), path)`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE files SET computer = COALESCE(computer, ''), disk_label = COALESCE(disk_label, '')
+			WHERE computer IS NULL OR disk_label IS NULL`)
+		return err
+	}},
+	{"record scan outcomes", func(tx *sql.Tx) error {
+		for _, column := range []string{"finished_at TEXT", "file_count INTEGER", "error_count INTEGER", "total_bytes INTEGER"} {
+			if _, err := tx.Exec("ALTER TABLE scans ADD COLUMN " + column); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"record scan date ranges", func(tx *sql.Tx) error {
+		for _, column := range []string{"modified_after", "modified_before"} {
+			if _, err := tx.Exec("ALTER TABLE scans ADD COLUMN " + column + " TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"create quarantine table", func(tx *sql.Tx) error {
+		// Files moved aside by dedupe -quarantine, with their index rows.
+		_, err := tx.Exec(`CREATE TABLE quarantine (
+			id INTEGER PRIMARY KEY,
+			computer TEXT,
+			disk_label TEXT,
+			path TEXT NOT NULL,
+			quarantine_path TEXT NOT NULL,
+			size INTEGER,
+			mtime INTEGER,
+			hash TEXT,
+			hash_algo TEXT,
+			moved_at TEXT NOT NULL
+		)`)
+		return err
+	}},
+	{"create resolved copies table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(resolvedSchema)
+		return err
+	}},
+	{"create actions log", func(tx *sql.Tx) error {
+		_, err := tx.Exec(actionsSchema)
+		return err
+	}},
+	// Rows for files a rescan finds missing are kept with the time they went,
+	// and every query over the index skips them.
+	{"mark removed files", func(tx *sql.Tx) error {
+		_, err := tx.Exec("ALTER TABLE files ADD COLUMN removed_at TEXT")
+		return err
+	}},
+	{"remember plan and log files", func(tx *sql.Tx) error {
+		_, err := tx.Exec(artifactsSchema)
+		return err
+	}},
+	// db enable-checksums used to add the row_sum column itself, and having
+	// it meant checksums were on. The column now always exists and the
+	// settings table says whether they are.
+	{"add row checksums", func(tx *sql.Tx) error {
+		var enabled int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info('files') WHERE name = 'row_sum'").Scan(&enabled); err != nil {
+			return err
+		}
+		if enabled == 0 {
+			if _, err := tx.Exec("ALTER TABLE files ADD COLUMN row_sum TEXT"); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("CREATE TABLE settings (name TEXT PRIMARY KEY, value TEXT NOT NULL)"); err != nil {
+			return err
+		}
+		if enabled > 0 {
+			_, err := tx.Exec("INSERT INTO settings(name, value) VALUES(?, 'on')", rowSumsSetting)
+			return err
+		}
+		return nil
+	}},
+	{"create triage table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(triageSchema)
+		return err
+	}},
+	{"create audit tables", func(tx *sql.Tx) error {
+		_, err := tx.Exec(auditSchema)
+		return err
+	}},
+}
+
+// migrateSchema brings db up to the latest schema, applying the migrations it
+// hasn't had yet. A database written by a newer release is refused rather
+// than modified.
+func migrateSchema(db *sql.DB) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+	var version int
+	err := db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err = db.Exec("INSERT INTO schema_version(version) VALUES(0)"); err != nil {
+			return fmt.Errorf("failed to initialize schema_version: %v", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this release supports (%d); upgrade dff", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		m := migrations[i]
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %v", i+1, err)
+		}
+		if err := m.apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %v", i+1, m.description, err)
+		}
+		if _, err := tx.Exec("UPDATE schema_version SET version = ?", i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %v", i+1, m.description, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d (%s): %v", i+1, m.description, err)
+		}
+	}
+	return nil
+}
+
+func addColumnIfMissing(db sqlExecutor, table, column, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
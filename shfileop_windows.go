@@ -0,0 +1,30 @@
+//go:build windows && !386 && !arm
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// shFileOpStruct is SHFILEOPSTRUCTW as 64-bit Windows lays it out, which is
+// Go's natural layout.
+type shFileOpStruct struct {
+	hwnd                  uintptr
+	wFunc                 uint32
+	pFrom                 *uint16
+	pTo                   *uint16
+	fFlags                uint16
+	fAnyOperationsAborted int32
+	hNameMappings         uintptr
+	lpszProgressTitle     *uint16
+}
+
+// shFileOperation runs SHFileOperationW with fn on the files in from, a list
+// ended by an empty name. It returns the result code and whether the
+// operation was aborted.
+func shFileOperation(fn uint32, from []uint16, flags uint16) (uintptr, bool) {
+	op := shFileOpStruct{wFunc: fn, pFrom: &from[0], fFlags: flags}
+	ret, _, _ := syscall.NewLazyDLL("shell32.dll").NewProc("SHFileOperationW").Call(uintptr(unsafe.Pointer(&op)))
+	return ret, op.fAnyOperationsAborted != 0
+}
@@ -0,0 +1,38 @@
+//go:build windows && (386 || arm)
+
+package main
+
+import (
+	"encoding/binary"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// shFileOpStruct is SHFILEOPSTRUCTW as 32-bit Windows lays it out. shellapi.h
+// packs it to 1 byte there, so fAnyOperationsAborted directly follows the
+// 2-byte fFlags at offset 18 where Go would align it to 20. The fields are
+// written at their offsets instead.
+type shFileOpStruct [30]byte
+
+// Offsets of the fields shFileOperation uses.
+const (
+	shFileOpFunc    = 4
+	shFileOpFrom    = 8
+	shFileOpFlags   = 16
+	shFileOpAborted = 18
+)
+
+// shFileOperation runs SHFileOperationW with fn on the files in from, a list
+// ended by an empty name. It returns the result code and whether the
+// operation was aborted.
+func shFileOperation(fn uint32, from []uint16, flags uint16) (uintptr, bool) {
+	var op shFileOpStruct
+	binary.LittleEndian.PutUint32(op[shFileOpFunc:], fn)
+	binary.LittleEndian.PutUint32(op[shFileOpFrom:], uint32(uintptr(unsafe.Pointer(&from[0]))))
+	binary.LittleEndian.PutUint16(op[shFileOpFlags:], flags)
+	ret, _, _ := syscall.NewLazyDLL("shell32.dll").NewProc("SHFileOperationW").Call(uintptr(unsafe.Pointer(&op[0])))
+	// from is only referenced from op as a number, so keep it alive until the call is done.
+	runtime.KeepAlive(from)
+	return ret, binary.LittleEndian.Uint32(op[shFileOpAborted:]) != 0
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarConfig controls how files tied to a primary, such as a photo's XMP
+// metadata or a video's THM thumbnail and SRT subtitles, are treated.
+type sidecarConfig struct {
+	// Extensions lists the sidecar extensions, including the dot.
+	Extensions []string `json:"extensions"`
+	// Action is "together" (a copy's sidecars go wherever the copy goes) or
+	// "warn" (sidecars stay put and every copy that has them is flagged).
+	Action string `json:"action"`
+}
+
+var defaultSidecarExtensions = []string{".xmp", ".thm", ".srt"}
+
+const (
+	sidecarsTogether = "together"
+	sidecarsWarn     = "warn"
+)
+
+// resolveSidecars fills in the defaults for a missing or partial config.
+func resolveSidecars(cfg *sidecarConfig) (sidecarConfig, error) {
+	resolved := sidecarConfig{Extensions: defaultSidecarExtensions, Action: sidecarsTogether}
+	if cfg == nil {
+		return resolved, nil
+	}
+	if cfg.Extensions != nil {
+		resolved.Extensions = nil
+		for _, ext := range cfg.Extensions {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			resolved.Extensions = append(resolved.Extensions, strings.ToLower(ext))
+		}
+	}
+	switch cfg.Action {
+	case "":
+	case sidecarsTogether, sidecarsWarn:
+		resolved.Action = cfg.Action
+	default:
+		return resolved, fmt.Errorf("unknown sidecar action %q (want %s or %s)", cfg.Action, sidecarsTogether, sidecarsWarn)
+	}
+	return resolved, nil
+}
+
+func (c sidecarConfig) isSidecar(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range c.Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// sidecar is a recorded file belonging to a primary, with the size and
+// modification time it was recorded with.
+type sidecar struct {
+	path        string
+	size, mtime int64
+}
+
+// findSidecars returns the recorded sidecars of path on the same computer and
+// disk, named either photo.jpg.xmp or photo.xmp for photo.jpg. A sidecar named
+// after the stem alone is left out when another primary shares that stem,
+// such as photo.nef next to photo.jpg, since it may belong to that one.
+// Extensions are matched in lower and upper case so lookups stay on the
+// unique index.
+func (c sidecarConfig) findSidecars(db *sql.DB, computerName, diskLabel, path string) ([]sidecar, error) {
+	if c.isSidecar(path) {
+		return nil, nil
+	}
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+	bases := []string{path}
+	shared, err := c.stemShared(db, computerName, diskLabel, path, stem)
+	if err != nil {
+		return nil, err
+	}
+	if !shared {
+		bases = append(bases, stem)
+	}
+	seen := map[string]bool{}
+	var candidates []any
+	for _, ext := range c.Extensions {
+		for _, base := range bases {
+			for _, e := range []string{ext, strings.ToUpper(ext)} {
+				if !seen[base+e] {
+					seen[base+e] = true
+					candidates = append(candidates, base+e)
+				}
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	args := append([]any{computerName, diskLabel}, candidates...)
+	rows, err := db.Query(`SELECT path, size, COALESCE(mtime, 0) FROM files WHERE computer = ? AND disk_label = ? AND removed_at IS NULL
+		AND path IN (?`+strings.Repeat(", ?", len(candidates)-1)+`) ORDER BY path`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up sidecars: %v", err)
+	}
+	defer rows.Close()
+	var found []sidecar
+	for rows.Next() {
+		var s sidecar
+		if err := rows.Scan(&s.path, &s.size, &s.mtime); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		found = append(found, s)
+	}
+	return found, rows.Err()
+}
+
+// stemShared reports whether a recorded file other than path, and other than
+// a sidecar, is named stem plus an extension. The range stays on the unique
+// index, since "/" follows "." in every encoding.
+func (c sidecarConfig) stemShared(db *sql.DB, computerName, diskLabel, path, stem string) (bool, error) {
+	rows, err := db.Query(`SELECT path FROM files WHERE path >= ? AND path < ? AND computer = ? AND disk_label = ? AND removed_at IS NULL`,
+		stem+".", stem+"/", computerName, diskLabel)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up sidecars: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var other string
+		if err := rows.Scan(&other); err != nil {
+			return false, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if other != path && strings.TrimSuffix(other, filepath.Ext(other)) == stem && !c.isSidecar(other) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
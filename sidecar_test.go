@@ -0,0 +1,36 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFindSidecarsLeavesSharedStem(t *testing.T) {
+	db := testDB(t)
+	for _, path := range []string{"/a/photo.jpg", "/a/photo.nef", "/a/photo.xmp", "/a/photo.jpg.xmp", "/b/photo.jpg", "/b/photo.xmp"} {
+		if _, err := db.Exec(`INSERT INTO files(computer, disk_label, path, size) VALUES('pc', 'C', ?, 1)`, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := resolveSidecars(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string][]string{
+		// photo.xmp may belong to photo.nef, which stays.
+		"/a/photo.jpg": {"/a/photo.jpg.xmp"},
+		"/b/photo.jpg": {"/b/photo.xmp"},
+	} {
+		found, err := cfg.findSidecars(db, "pc", "C", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, sc := range found {
+			got = append(got, sc.path)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("sidecars of %s = %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/text/message"
+)
+
+// scanStats collects the per-directory timings and error counts printed in
+// the summary at the end of a run. Walks keep their own directory timings and
+// merge them once when they finish, so the mutex is not taken per file.
+type scanStats struct {
+	mu       sync.Mutex
+	dirTimes map[string]time.Duration
+	errors   map[string]int
+}
+
+var stats = scanStats{dirTimes: map[string]time.Duration{}, errors: map[string]int{}}
+
+func (s *scanStats) mergeDirTimes(times map[string]time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for dir, d := range times {
+		s.dirTimes[dir] += d
+	}
+}
+
+// addError counts err under "<stage>: <kind>", e.g. "walk: permission denied".
+func (s *scanStats) addError(stage string, err error) {
+	kind := "other"
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		kind = "permission denied"
+	case errors.Is(err, fs.ErrNotExist):
+		kind = "not found"
+	}
+	s.mu.Lock()
+	s.errors[stage+": "+kind]++
+	s.mu.Unlock()
+}
+
+const slowestDirCount = 10
+
+func (s *scanStats) write(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := message.NewPrinter(message.MatchLanguage("en"))
+
+	phases.write(w)
+
+	type dirTime struct {
+		dir string
+		d   time.Duration
+	}
+	dirs := make([]dirTime, 0, len(s.dirTimes))
+	for dir, d := range s.dirTimes {
+		dirs = append(dirs, dirTime{dir, d})
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].d > dirs[j].d })
+	if len(dirs) > slowestDirCount {
+		dirs = dirs[:slowestDirCount]
+	}
+	if len(dirs) > 0 {
+		fmt.Fprintln(w, "Slowest directories:")
+		for _, dt := range dirs {
+			fmt.Fprintf(w, "  %12s  %s\n", dt.d.Round(time.Millisecond), dt.dir)
+		}
+	}
+
+	if len(s.errors) == 0 {
+		fmt.Fprintln(w, "Errors: none")
+		return
+	}
+	categories := make([]string, 0, len(s.errors))
+	for c := range s.errors {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+	fmt.Fprintln(w, "Errors by category:")
+	for _, c := range categories {
+		p.Fprintf(w, "  %-28s %10d\n", c, s.errors[c])
+	}
+}
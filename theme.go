@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// reportTheme selects which columns a report includes and whether it starts
+// with a header row.
+type reportTheme struct {
+	Columns []string `json:"columns"`
+	Header  *bool    `json:"header,omitempty"`
+}
+
+func (t reportTheme) header() bool {
+	return t.Header == nil || *t.Header
+}
+
+// reportColumns are the files table columns a report may select.
+var reportColumns = map[string]bool{
+	"id":         true,
+	"path":       true,
+	"computer":   true,
+	"disk_label": true,
+	"size":       true,
+}
+
+var noHeader = false
+
+var builtinThemes = map[string]reportTheme{
+	"detailed":   {Columns: []string{"id", "path", "computer", "disk_label", "size"}},
+	"compact":    {Columns: []string{"path", "size"}},
+	"paths-only": {Columns: []string{"path"}, Header: &noHeader},
+}
+
+// resolveTheme picks the named theme (config themes override built-in ones),
+// applying a comma-separated column list on top when one is given.
+func resolveTheme(cfg *config, name, columns string) (reportTheme, error) {
+	if name == "" {
+		name = cfg.Theme
+	}
+	if name == "" {
+		name = "detailed"
+	}
+	theme, ok := cfg.Themes[name]
+	if !ok {
+		theme, ok = builtinThemes[name]
+	}
+	if !ok {
+		return reportTheme{}, fmt.Errorf("unknown theme %q (available: %s)", name, strings.Join(themeNames(cfg), ", "))
+	}
+	if columns != "" {
+		theme.Columns = nil
+		for _, c := range strings.Split(columns, ",") {
+			theme.Columns = append(theme.Columns, strings.TrimSpace(c))
+		}
+	}
+	if len(theme.Columns) == 0 {
+		return reportTheme{}, fmt.Errorf("theme %q selects no columns", name)
+	}
+	for _, c := range theme.Columns {
+		if !reportColumns[c] {
+			return reportTheme{}, fmt.Errorf("unknown report column %q", c)
+		}
+	}
+	return theme, nil
+}
+
+func themeNames(cfg *config) []string {
+	seen := map[string]bool{}
+	var names []string
+	for name := range builtinThemes {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for name := range cfg.Themes {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type phase int
+
+const (
+	phaseWalk phase = iota
+	phaseStat
+	phaseHash
+	phaseInsert
+	phaseCount
+)
+
+var phaseNames = [phaseCount]string{"walk", "stat", "hash", "insert"}
+
+// phaseTimings accumulates the time spent in each scan phase across all
+// drive goroutines, so the totals can exceed the wall-clock run time.
+type phaseTimings struct {
+	nanos [phaseCount]atomic.Int64
+}
+
+var phases phaseTimings
+
+func (pt *phaseTimings) add(p phase, d time.Duration) {
+	pt.nanos[p].Add(int64(d))
+}
+
+// track times p and marks it as a region in the runtime trace. Call the
+// returned function when the phase ends.
+func (pt *phaseTimings) track(p phase) func() {
+	region := trace.StartRegion(context.Background(), phaseNames[p])
+	start := time.Now()
+	return func() {
+		pt.add(p, time.Since(start))
+		region.End()
+	}
+}
+
+func (pt *phaseTimings) write(w io.Writer) {
+	var total time.Duration
+	for p := range phaseCount {
+		total += time.Duration(pt.nanos[p].Load())
+	}
+	fmt.Fprintln(w, "Phase timings (cumulative across drives):")
+	for p := range phaseCount {
+		d := time.Duration(pt.nanos[p].Load())
+		pct := 0.0
+		if total > 0 {
+			pct = float64(d) / float64(total) * 100
+		}
+		fmt.Fprintf(w, "  %-7s %12s  %5.1f%%\n", phaseNames[p], d.Round(time.Millisecond), pct)
+	}
+}
+
+// exitHooks run before the process ends through exit, so work that a defer
+// in main would do, like stopping a trace, isn't lost on an error path.
+var exitHooks []func()
+
+// exit runs the exit hooks, last registered first, then ends the process with
+// code. main calls it instead of os.Exit.
+func exit(code int) {
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	os.Exit(code)
+}
+
+// traceOutputs lists every file startTracing writes for the given trace path.
+func traceOutputs(path string) []string {
+	base := strings.TrimSuffix(path, ".out")
+	return []string{path, base + ".cpu.pprof", base + ".heap.pprof", base + ".phases.txt"}
+}
+
+// startTracing writes a runtime trace to path and a CPU profile next to it.
+// The returned function stops both, writes a heap profile and the phase
+// timings, and must be called before the program exits; later calls do
+// nothing.
+func startTracing(path string) (func(), error) {
+	traceFile, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace file: %v", err)
+	}
+	base := strings.TrimSuffix(path, ".out")
+	cpuFile, err := os.Create(base + ".cpu.pprof")
+	if err != nil {
+		traceFile.Close()
+		return nil, fmt.Errorf("failed to create CPU profile: %v", err)
+	}
+	if err := trace.Start(traceFile); err != nil {
+		traceFile.Close()
+		cpuFile.Close()
+		return nil, fmt.Errorf("failed to start runtime trace: %v", err)
+	}
+	if err := pprof.StartCPUProfile(cpuFile); err != nil {
+		trace.Stop()
+		traceFile.Close()
+		cpuFile.Close()
+		return nil, fmt.Errorf("failed to start CPU profile: %v", err)
+	}
+	return sync.OnceFunc(func() {
+		pprof.StopCPUProfile()
+		cpuFile.Close()
+		trace.Stop()
+		traceFile.Close()
+
+		if heapFile, err := os.Create(base + ".heap.pprof"); err == nil {
+			if err := pprof.WriteHeapProfile(heapFile); err != nil {
+				fmt.Printf("[ERROR] Failed to write heap profile: %v\n", err)
+			}
+			heapFile.Close()
+		} else {
+			fmt.Printf("[ERROR] Failed to create heap profile: %v\n", err)
+		}
+
+		if phaseFile, err := os.Create(base + ".phases.txt"); err == nil {
+			phases.write(phaseFile)
+			phaseFile.Close()
+		} else {
+			fmt.Printf("[ERROR] Failed to write phase timings: %v\n", err)
+		}
+		fmt.Printf("Diagnostics written to %s, %s.cpu.pprof, %s.heap.pprof and %s.phases.txt\n", path, base, base, base)
+	}), nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/message"
+)
+
+// triageSchema stores the decisions made in triage so each session picks up
+// where the last one stopped. A set is identified by its content hash and size.
+const triageSchema = `
+CREATE TABLE IF NOT EXISTS triage_decisions (
+	hash_algo TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	keep_computer TEXT,
+	keep_disk_label TEXT,
+	keep_path TEXT,
+	decided_at TEXT NOT NULL,
+	PRIMARY KEY (hash_algo, hash, size)
+);`
+
+const (
+	triageKeep   = "keep"
+	triageIgnore = "ignore"
+)
+
+// nextTriageSet returns the undecided duplicate set with the most reclaimable
+// bytes, skipping the first offset. Every set takes one decision, so ordering by
+// waste is ordering by bytes per decision.
+func nextTriageSet(db *sql.DB, algo string, offset int) (*duplicateSet, error) {
+	var s duplicateSet
+	err := db.QueryRow(`SELECT f.hash, f.size FROM files f
+		WHERE f.hash IS NOT NULL AND f.hash_algo = ?1 AND f.removed_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM triage_decisions d
+			WHERE d.hash_algo = ?1 AND d.hash = f.hash AND d.size = f.size)
+		GROUP BY f.hash, f.size HAVING COUNT(*) > 1
+		ORDER BY f.size * (COUNT(*) - 1) DESC, f.hash LIMIT 1 OFFSET ?2`, algo, offset).Scan(&s.key, &s.size)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query duplicate sets: %v", err)
+	}
+	rows, err := db.Query(`SELECT COALESCE(computer, ''), COALESCE(disk_label, ''), path, COALESCE(created, 0) FROM files
+		WHERE hash_algo = ? AND hash = ? AND size = ? AND removed_at IS NULL ORDER BY computer, disk_label, path`, algo, s.key, s.size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query duplicate set: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f duplicateFile
+		if err := rows.Scan(&f.computer, &f.diskLabel, &f.path, &f.created); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		s.files = append(s.files, f)
+	}
+	return &s, rows.Err()
+}
+
+func recordTriageDecision(db *sql.DB, algo string, s *duplicateSet, action string, keep *duplicateFile) error {
+	var computer, diskLabel, path any
+	if keep != nil {
+		computer, diskLabel, path = keep.computer, keep.diskLabel, keep.path
+	}
+	_, err := db.Exec(`INSERT OR REPLACE INTO triage_decisions(hash_algo, hash, size, action, keep_computer, keep_disk_label, keep_path, decided_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`, algo, s.key, s.size, action, computer, diskLabel, path, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to record decision: %v", err)
+	}
+	return nil
+}
+
+// launchCompareTool starts the configured compare tool on two copies without
+// waiting for it to exit. Only copies recorded by this computer can be opened.
+func launchCompareTool(tool []string, a, b duplicateFile) error {
+	if len(tool) == 0 {
+		return errors.New(`no compare tool configured; set "compare_tool" in the config file`)
+	}
+	local := getComputerName()
+	for _, f := range []duplicateFile{a, b} {
+		if f.computer != local {
+			return fmt.Errorf("%s was recorded on %s, not this computer", f.path, f.computer)
+		}
+	}
+	args := make([]string, 0, len(tool)+1)
+	placed := false
+	for _, arg := range tool[1:] {
+		if strings.Contains(arg, "{1}") || strings.Contains(arg, "{2}") {
+			placed = true
+		}
+		args = append(args, strings.NewReplacer("{1}", a.path, "{2}", b.path).Replace(arg))
+	}
+	if !placed {
+		args = append(args, a.path, b.path)
+	}
+	cmd := exec.Command(tool[0], args...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", tool[0], err)
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// earliestCreated returns the index of the copy created first, which is most
+// likely the original, or -1 when any copy's creation time is unknown.
+func earliestCreated(files []duplicateFile) int {
+	best := -1
+	for i, f := range files {
+		if f.created == 0 {
+			return -1
+		}
+		if best < 0 || f.created < files[best].created {
+			best = i
+		}
+	}
+	return best
+}
+
+// parseCompare reads "c", "c 2" or "c 1 3" into the two copies to compare,
+// defaulting to the first two.
+func parseCompare(answer string, copies int) (int, int, bool) {
+	fields := strings.Fields(answer)
+	if len(fields) == 0 || fields[0] != "c" || len(fields) > 3 {
+		return 0, 0, false
+	}
+	picks := []int{1, 2}
+	for i, f := range fields[1:] {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 || n > copies {
+			return 0, 0, false
+		}
+		picks[i] = n
+	}
+	if len(fields) == 2 && picks[0] == picks[1] {
+		picks[1] = 1
+	}
+	return picks[0] - 1, picks[1] - 1, picks[0] != picks[1]
+}
+
+// runTriage walks the user through undecided duplicate sets, largest waste
+// first, one at a time until they quit, run out of sets, or limit has passed.
+// For each set they pick the copy to keep, or let the earliest-created one be
+// kept as the original, or mark the set as intentional; the decision is saved
+// immediately. They can also open two copies in compareTool first.
+func runTriage(db *sql.DB, in io.Reader, out io.Writer, algo string, limit time.Duration, compareTool []string) error {
+	p := message.NewPrinter(message.MatchLanguage("en"))
+	input := bufio.NewScanner(in)
+	deadline := time.Now().Add(limit)
+	skipped, decided := 0, 0
+	var reclaimable int64
+	defer func() {
+		p.Fprintf(out, "\nDecided %d sets this session, %d bytes marked reclaimable.\n", decided, reclaimable)
+	}()
+	for {
+		if limit > 0 && time.Now().After(deadline) {
+			p.Fprintf(out, "\nTime's up after %s.\n", limit)
+			return nil
+		}
+		s, err := nextTriageSet(db, algo, skipped)
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			fmt.Fprintln(out, "\nNo undecided duplicate sets left.")
+			return nil
+		}
+		if sampled, ok := strings.CutPrefix(s.key, samplePrefix); ok {
+			p.Fprintf(out, "\n%d copies of %d bytes, %d bytes reclaimable (sampled %s %s, unverified: not every byte compared)\n",
+				len(s.files), s.size, s.waste(), algo, sampled[:min(16, len(sampled))])
+		} else {
+			p.Fprintf(out, "\n%d copies of %d bytes, %d bytes reclaimable (%s %s)\n", len(s.files), s.size, s.waste(), algo, s.key[:min(16, len(s.key))])
+		}
+		original := earliestCreated(s.files)
+		for i, f := range s.files {
+			created := ""
+			if f.created != 0 {
+				created = " (created " + time.Unix(0, f.created).Format("2006-01-02 15:04") + ")"
+			}
+			fmt.Fprintf(out, "  %d) [%s] [%s] %s%s\n", i+1, f.computer, f.diskLabel, f.path, created)
+		}
+		for {
+			fmt.Fprintf(out, "Keep which copy? [1-%d], o = original (created first), c [A B] = compare, i = intentional, s = skip, q = quit: ", len(s.files))
+			if !input.Scan() {
+				return input.Err()
+			}
+			answer := strings.TrimSpace(strings.ToLower(input.Text()))
+			if answer == "o" {
+				if original < 0 {
+					fmt.Fprintln(out, "Creation times aren't known for every copy; pick one by number.")
+					continue
+				}
+				answer = strconv.Itoa(original + 1)
+			}
+			if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(s.files) {
+				if err := recordTriageDecision(db, algo, s, triageKeep, &s.files[n-1]); err != nil {
+					return err
+				}
+				decided++
+				reclaimable += s.waste()
+				break
+			}
+			if a, b, ok := parseCompare(answer, len(s.files)); ok {
+				if err := launchCompareTool(compareTool, s.files[a], s.files[b]); err != nil {
+					fmt.Fprintf(out, "%v\n", err)
+				}
+				continue
+			}
+			switch answer {
+			case "i":
+				if err := recordTriageDecision(db, algo, s, triageIgnore, nil); err != nil {
+					return err
+				}
+				decided++
+			case "s":
+				skipped++
+			case "q":
+				return nil
+			default:
+				continue
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// usnSchema keeps the change journal position each volume was last scanned up
+// to, so a rescan can replay the changes since instead of walking again.
+const usnSchema = `
+CREATE TABLE IF NOT EXISTS usn_journals (
+	computer TEXT NOT NULL,
+	disk_label TEXT NOT NULL,
+	root TEXT NOT NULL,
+	journal_id INTEGER NOT NULL,
+	next_usn INTEGER NOT NULL,
+	PRIMARY KEY (computer, disk_label, root)
+);`
+
+// usnCursor is a position in a volume's NTFS change journal. A new journal id
+// means the journal was recreated and older positions mean nothing.
+type usnCursor struct {
+	journalID uint64
+	next      int64
+}
+
+// usnChanges is what the journal reports between two positions: paths that
+// were created or modified, renamed directories whose contents moved with
+// them, and paths that no longer exist. created holds the files that were
+// created in the range, by path.
+type usnChanges struct {
+	changed, rewalk, removed []string
+	created                  map[string]usnCreation
+}
+
+// usnCreation is when a file was created and the journal's SourceInfo flags
+// for the change, which say whether a program or a replication service made it.
+type usnCreation struct {
+	at         time.Time
+	sourceInfo uint32
+}
+
+// USN_SOURCE_* flags from SourceInfo.
+const (
+	usnSourceDataManagement              = 0x1
+	usnSourceReplicationManagement       = 0x4
+	usnSourceClientReplicationManagement = 0x8
+)
+
+// source describes what made the change in words.
+func (c usnCreation) source() string {
+	switch {
+	case c.sourceInfo&usnSourceClientReplicationManagement != 0:
+		return "a cloud sync client such as OneDrive"
+	case c.sourceInfo&usnSourceReplicationManagement != 0:
+		return "a replication service such as DFS Replication"
+	case c.sourceInfo&usnSourceDataManagement != 0:
+		return "storage management such as Data Deduplication"
+	}
+	return "a program on this computer"
+}
+
+// errUSNUnavailable means the journal can't account for every change since
+// the stored position, so the volume has to be walked.
+var errUSNUnavailable = errors.New("the change journal no longer covers the last scan")
+
+func loadUSNCursor(db *sql.DB, computerName, diskLabel, root string) (usnCursor, bool, error) {
+	var c usnCursor
+	var id int64
+	err := db.QueryRow("SELECT journal_id, next_usn FROM usn_journals WHERE computer = ? AND disk_label = ? AND root = ?",
+		computerName, diskLabel, root).Scan(&id, &c.next)
+	if err == sql.ErrNoRows {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, fmt.Errorf("failed to load journal position: %v", err)
+	}
+	c.journalID = uint64(id)
+	return c, true, nil
+}
+
+func saveUSNCursor(db *sql.DB, computerName, diskLabel, root string, c usnCursor) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO usn_journals(computer, disk_label, root, journal_id, next_usn) VALUES(?, ?, ?, ?, ?)",
+		computerName, diskLabel, root, int64(c.journalID), c.next)
+	if err != nil {
+		return fmt.Errorf("failed to save journal position: %v", err)
+	}
+	return nil
+}
+
+// applyUSNChanges brings the rows for root up to date from the journal:
+// removed paths are marked removed (with everything below them), renamed
+// directories are walked again, and changed paths are recorded like a file
+// list. Rows are relative to volumeRoot when relative is set. It returns the
+// number of entries recorded.
+func applyUSNChanges(ctx context.Context, db *sql.DB, changes usnChanges, computerName, diskLabel, root, volumeRoot string, relative bool,
+	record fileRecorder, progress *driveProgress, skip walkFilter, workers int) (int, error) {
+	remove, err := db.Prepare(`UPDATE files SET removed_at = ?5 WHERE computer = ?1 AND disk_label = ?2
+		AND (path = ?3 OR substr(path, 1, length(?3) + 1) = ?3 || ?4) AND removed_at IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+	defer remove.Close()
+	inScope := func(p string) bool {
+		return subtreeContains(root, p) && !skip.skipsAncestor(root, p)
+	}
+	for _, p := range changes.removed {
+		if !inScope(p) || p == root {
+			continue
+		}
+		stored := p
+		if relative {
+			if stored, err = filepath.Rel(volumeRoot, p); err != nil {
+				continue
+			}
+		}
+		if _, err := remove.Exec(computerName, diskLabel, stored, string(os.PathSeparator), time.Now().UTC().Format(time.RFC3339)); err != nil {
+			progress.addError("insert", err)
+			progress.logf("[ERROR] Failed to remove %s: %v\n", p, err)
+		}
+	}
+
+	count := 0
+	for _, dir := range changes.rewalk {
+		if !inScope(dir) {
+			continue
+		}
+		n, err := walkFiles(ctx, dir, record, progress, skip, workers)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	var changed []string
+	for _, p := range changes.changed {
+		if inScope(p) {
+			changed = append(changed, p)
+		}
+	}
+	n, err := recordFileList(ctx, changed, record, progress, skip)
+	return count + n, err
+}
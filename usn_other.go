@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+var errNoUSNJournal = errors.New("change journals are only read on Windows")
+
+func queryUSNJournal(drive string) (usnCursor, error) {
+	return usnCursor{}, errNoUSNJournal
+}
+
+func readUSNJournal(drive string, since, until usnCursor) (usnChanges, error) {
+	return usnChanges{}, errNoUSNJournal
+}
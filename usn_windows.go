@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	fsctlQueryUSNJournal = 0x000900f4
+	fsctlReadUSNJournal  = 0x000900bb
+
+	usnReasonFileCreate    = 0x00000100
+	usnReasonFileDelete    = 0x00000200
+	usnReasonRenameOldName = 0x00001000
+	usnReasonRenameNewName = 0x00002000
+
+	errorJournalDeleteInProgress syscall.Errno = 1178
+	errorJournalNotActive        syscall.Errno = 1179
+	errorJournalEntryDeleted     syscall.Errno = 1181
+
+	fileFlagBackupSemantics = 0x02000000
+	fileAttributeDirectory  = 0x10
+)
+
+// openVolume opens the raw volume behind drive (C:\), which needs admin rights.
+func openVolume(drive string) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(`\\.\` + drive[0:2])
+	if err != nil {
+		return 0, err
+	}
+	return syscall.CreateFile(name, syscall.GENERIC_READ, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, 0, 0)
+}
+
+func queryJournal(volume syscall.Handle) (id uint64, first, next int64, err error) {
+	var data struct {
+		UsnJournalID                      uint64
+		FirstUsn, NextUsn, LowestValidUsn int64
+		MaxUsn                            int64
+		MaximumSize, AllocationDelta      uint64
+	}
+	var returned uint32
+	err = syscall.DeviceIoControl(volume, fsctlQueryUSNJournal, nil, 0,
+		(*byte)(unsafe.Pointer(&data)), uint32(unsafe.Sizeof(data)), &returned, nil)
+	return data.UsnJournalID, data.FirstUsn, data.NextUsn, err
+}
+
+// queryUSNJournal returns the current end of drive's change journal.
+func queryUSNJournal(drive string) (usnCursor, error) {
+	volume, err := openVolume(drive)
+	if err != nil {
+		return usnCursor{}, err
+	}
+	defer syscall.CloseHandle(volume)
+	id, _, next, err := queryJournal(volume)
+	if err != nil {
+		return usnCursor{}, fmt.Errorf("failed to query the change journal: %v", err)
+	}
+	return usnCursor{journalID: id, next: next}, nil
+}
+
+// fileIDResolver turns NTFS file reference numbers into current paths.
+type fileIDResolver struct {
+	hint  syscall.Handle
+	cache map[uint64]string
+}
+
+func (r *fileIDResolver) path(id uint64) (string, error) {
+	if p, ok := r.cache[id]; ok {
+		return p, nil
+	}
+	descriptor := struct {
+		Size, Type uint32
+		FileID     uint64
+		_          uint64
+	}{Size: 24, FileID: id}
+	openFileByID := syscall.NewLazyDLL("kernel32.dll").NewProc("OpenFileById")
+	h, _, e1 := openFileByID.Call(uintptr(r.hint), uintptr(unsafe.Pointer(&descriptor)), 0,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, 0, fileFlagBackupSemantics)
+	if syscall.Handle(h) == syscall.InvalidHandle {
+		return "", e1
+	}
+	defer syscall.CloseHandle(syscall.Handle(h))
+	var buf [syscall.MAX_LONG_PATH]uint16
+	getFinalPathNameByHandleW := syscall.NewLazyDLL("kernel32.dll").NewProc("GetFinalPathNameByHandleW")
+	n, _, e1 := getFinalPathNameByHandleW.Call(h, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0)
+	if n == 0 || int(n) > len(buf) {
+		return "", e1
+	}
+	p := strings.TrimPrefix(syscall.UTF16ToString(buf[:n]), `\\?\`)
+	r.cache[id] = p
+	return p, nil
+}
+
+// readUSNJournal lists what changed on drive between since and until. Deleted
+// and renamed-away entries are resolved through their parent directory, which
+// still exists unless it was deleted too, in which case its own record covers
+// them. It fails with errUSNUnavailable when the journal was recreated or has
+// wrapped past since.
+func readUSNJournal(drive string, since, until usnCursor) (usnChanges, error) {
+	var changes usnChanges
+	if since.journalID != until.journalID {
+		return changes, errUSNUnavailable
+	}
+	volume, err := openVolume(drive)
+	if err != nil {
+		return changes, err
+	}
+	defer syscall.CloseHandle(volume)
+	_, first, _, err := queryJournal(volume)
+	if err != nil {
+		return changes, fmt.Errorf("failed to query the change journal: %v", err)
+	}
+	if since.next < first {
+		return changes, errUSNUnavailable
+	}
+	rootName, err := syscall.UTF16PtrFromString(drive[0:3])
+	if err != nil {
+		return changes, err
+	}
+	root, err := syscall.CreateFile(rootName, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil, syscall.OPEN_EXISTING, fileFlagBackupSemantics, 0)
+	if err != nil {
+		return changes, err
+	}
+	defer syscall.CloseHandle(root)
+	resolver := &fileIDResolver{hint: root, cache: map[uint64]string{}}
+
+	type entry struct {
+		dir    bool
+		reason uint32
+		// Set from the record that created the file, if it is in range.
+		created    int64
+		sourceInfo uint32
+	}
+	current := map[uint64]entry{}
+	removed := map[string]bool{}
+	request := struct {
+		StartUsn                      int64
+		ReasonMask, ReturnOnlyOnClose uint32
+		Timeout, BytesToWaitFor       uint64
+		UsnJournalID                  uint64
+	}{StartUsn: since.next, ReasonMask: 0xFFFFFFFF, UsnJournalID: since.journalID}
+	buf := make([]byte, 64<<10)
+	for request.StartUsn < until.next {
+		var returned uint32
+		err := syscall.DeviceIoControl(volume, fsctlReadUSNJournal,
+			(*byte)(unsafe.Pointer(&request)), uint32(unsafe.Sizeof(request)),
+			&buf[0], uint32(len(buf)), &returned, nil)
+		if errors.Is(err, errorJournalEntryDeleted) || errors.Is(err, errorJournalNotActive) || errors.Is(err, errorJournalDeleteInProgress) {
+			return changes, errUSNUnavailable
+		}
+		if err != nil {
+			return changes, fmt.Errorf("failed to read the change journal: %v", err)
+		}
+		if returned < 8 {
+			break
+		}
+		next := int64(binary.LittleEndian.Uint64(buf))
+		for off := uint32(8); off+60 <= returned; {
+			rec := buf[off:returned]
+			length := binary.LittleEndian.Uint32(rec)
+			if length < 60 || length > uint32(len(rec)) {
+				break
+			}
+			usn := int64(binary.LittleEndian.Uint64(rec[24:]))
+			if usn >= until.next {
+				break
+			}
+			off += length
+			nameLen := binary.LittleEndian.Uint16(rec[56:])
+			nameOff := binary.LittleEndian.Uint16(rec[58:])
+			if binary.LittleEndian.Uint16(rec[4:]) != 2 || uint32(nameOff)+uint32(nameLen) > length {
+				continue
+			}
+			id := binary.LittleEndian.Uint64(rec[8:])
+			parent := binary.LittleEndian.Uint64(rec[16:])
+			reason := binary.LittleEndian.Uint32(rec[40:])
+			attributes := binary.LittleEndian.Uint32(rec[52:])
+			name := make([]uint16, nameLen/2)
+			for i := range name {
+				name[i] = binary.LittleEndian.Uint16(rec[int(nameOff)+2*i:])
+			}
+			if reason&(usnReasonFileDelete|usnReasonRenameOldName) != 0 {
+				if dir, err := resolver.path(parent); err == nil {
+					removed[filepath.Join(dir, syscall.UTF16ToString(name))] = true
+				}
+			}
+			if reason&usnReasonFileDelete != 0 {
+				delete(current, id)
+			} else if reason&usnReasonRenameOldName == 0 {
+				e := current[id]
+				e.dir, e.reason = attributes&fileAttributeDirectory != 0, e.reason|reason
+				if reason&usnReasonFileCreate != 0 && e.created == 0 {
+					e.created = int64(binary.LittleEndian.Uint64(rec[32:]))
+					e.sourceInfo = binary.LittleEndian.Uint32(rec[44:])
+				}
+				current[id] = e
+			}
+		}
+		if next <= request.StartUsn {
+			break
+		}
+		request.StartUsn = next
+	}
+
+	for p := range removed {
+		changes.removed = append(changes.removed, p)
+	}
+	for id, e := range current {
+		p, err := resolver.path(id)
+		if err != nil {
+			// Gone again since; its delete record was handled above.
+			continue
+		}
+		if e.dir && e.reason&usnReasonRenameNewName != 0 {
+			changes.rewalk = append(changes.rewalk, p)
+		} else {
+			changes.changed = append(changes.changed, p)
+		}
+		if !e.dir && e.created != 0 {
+			if changes.created == nil {
+				changes.created = map[string]usnCreation{}
+			}
+			ft := syscall.Filetime{LowDateTime: uint32(e.created), HighDateTime: uint32(e.created >> 32)}
+			changes.created[p] = usnCreation{at: time.Unix(0, ft.Nanoseconds()), sourceInfo: e.sourceInfo}
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// verifyFull is the -verify mode that compares every copy with the kept one
+// byte by byte before dedupe deletes, moves or links it, for certainty beyond
+// the hash.
+const verifyFull = "full"
+
+func checkVerifyMode(mode string) error {
+	if mode != "" && mode != verifyFull {
+		return fmt.Errorf("unknown verify mode %q (want %s)", mode, verifyFull)
+	}
+	return nil
+}
+
+// verifyCopy compares c with keep byte by byte, then checks both again for
+// the size and modification time they were planned with, so neither can have
+// been changed while they were being read.
+func verifyCopy(keep, c dedupeCopy) error {
+	if err := sameContent(keep.path, c.path); err != nil {
+		return err
+	}
+	if err := unchangedOnDisk(keep.path, keep.size, keep.mtime); err != nil {
+		return fmt.Errorf("the kept copy %s", err)
+	}
+	return unchangedOnDisk(c.path, c.size, c.mtime)
+}
+
+// sameContent returns an error unless the files at a and b hold the same bytes.
+func sameContent(a, b string) error {
+	fa, err := os.Open(a)
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return err
+	}
+	defer fb.Close()
+	bufA, bufB := make([]byte, 1<<20), make([]byte, 1<<20)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return errors.New("its content differs from the kept copy")
+		}
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !endA {
+			return errA
+		}
+		if errB != nil && !endB {
+			return errB
+		}
+		if endA || endB {
+			if endA != endB {
+				return errors.New("its content differs from the kept copy")
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// readVersionInfo is only implemented on Windows, where version.dll parses
+// PE version resources; elsewhere installers are grouped by file name.
+func readVersionInfo(path string) (versionInfo, bool) {
+	return versionInfo{}, false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// readVersionInfo reads ProductName, CompanyName and ProductVersion from a
+// PE file's version resource via version.dll.
+func readVersionInfo(path string) (versionInfo, bool) {
+	versionDLL := syscall.NewLazyDLL("version.dll")
+	getFileVersionInfoSizeW := versionDLL.NewProc("GetFileVersionInfoSizeW")
+	getFileVersionInfoW := versionDLL.NewProc("GetFileVersionInfoW")
+	verQueryValueW := versionDLL.NewProc("VerQueryValueW")
+
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return versionInfo{}, false
+	}
+	size, _, _ := getFileVersionInfoSizeW.Call(uintptr(unsafe.Pointer(pathPtr)), 0)
+	if size == 0 {
+		return versionInfo{}, false
+	}
+	data := make([]byte, size)
+	ret, _, _ := getFileVersionInfoW.Call(uintptr(unsafe.Pointer(pathPtr)), 0, size, uintptr(unsafe.Pointer(&data[0])))
+	if ret == 0 {
+		return versionInfo{}, false
+	}
+
+	// VerQueryValueW points into data, so values are read back as offsets
+	// into the buffer instead of converting the returned address to a pointer.
+	base := uintptr(unsafe.Pointer(&data[0]))
+	query := func(subBlock string) ([]byte, bool) {
+		subPtr, err := syscall.UTF16PtrFromString(subBlock)
+		if err != nil {
+			return nil, false
+		}
+		var buf uintptr
+		var length uint32
+		ret, _, _ := verQueryValueW.Call(
+			base,
+			uintptr(unsafe.Pointer(subPtr)),
+			uintptr(unsafe.Pointer(&buf)),
+			uintptr(unsafe.Pointer(&length)),
+		)
+		if ret == 0 || length == 0 || buf < base || buf >= base+size {
+			return nil, false
+		}
+		return data[buf-base:], true
+	}
+	utf16At := func(b []byte, chars int) []uint16 {
+		u := make([]uint16, 0, chars)
+		for i := 0; i+1 < len(b) && len(u) < chars; i += 2 {
+			u = append(u, uint16(b[i])|uint16(b[i+1])<<8)
+		}
+		return u
+	}
+
+	// Use the first language/code page pair listed in the resource.
+	langCodePage := "040904b0"
+	if b, ok := query(`\VarFileInfo\Translation`); ok {
+		if pair := utf16At(b, 2); len(pair) == 2 {
+			langCodePage = fmt.Sprintf("%04x%04x", pair[0], pair[1])
+		}
+	}
+	stringValue := func(name string) string {
+		b, ok := query(`\StringFileInfo\` + langCodePage + `\` + name)
+		if !ok {
+			return ""
+		}
+		return syscall.UTF16ToString(utf16At(b, len(b)/2))
+	}
+
+	vi := versionInfo{
+		ProductName: stringValue("ProductName"),
+		CompanyName: stringValue("CompanyName"),
+		Version:     stringValue("ProductVersion"),
+	}
+	return vi, vi.ProductName != "" || vi.Version != ""
+}